@@ -0,0 +1,337 @@
+// Package adaptertest provides a conformance suite that runs a standard
+// battery of tests against any bridge.RegistryAdapter.
+//
+// Backends differ in what they can report back, so adapters describe their
+// capabilities through Options. A typical adapter test starts a local
+// stand-in for the backend, builds the adapter through its factory and
+// hands it to Run:
+//
+//	func TestConformance(t *testing.T) {
+//		adapter := new(Factory).New(uri)
+//		adaptertest.Run(t, adapter, adaptertest.Options{Services: true})
+//	}
+package adaptertest
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/registrator/bridge"
+)
+
+// DefaultExpiryTimeout is how long the expiry test waits for a registration
+// to disappear once its TTL has lapsed.
+const DefaultExpiryTimeout = 10 * time.Second
+
+type Options struct {
+	// Services reports that the adapter implements Services(). It enables
+	// the round-trip test and is used for lookups when Lookup is nil.
+	Services bool
+
+	// Tags reports that Services() returns the tags a service was
+	// registered with.
+	Tags bool
+
+	// Expiry reports that the backend drops a registration on its own once
+	// Service.TTL seconds pass without a Refresh.
+	Expiry bool
+
+	// ExpiryTimeout bounds the wait in the expiry test. It defaults to
+	// DefaultExpiryTimeout.
+	ExpiryTimeout time.Duration
+
+	// Lookup reports whether service is currently present in the backend.
+	// Adapters that don't implement Services() must provide it.
+	Lookup func(service *bridge.Service) (bool, error)
+
+	// Skip lists tests, by name, that the adapter is known not to pass.
+	Skip []string
+}
+
+var sequence int64
+
+// NewService returns a service shaped like the ones Bridge creates for the
+// given container and port, with an ID that matches the bridge's service ID
+// pattern so cleanup logic recognises it.
+func NewService(name, container string, port int) *bridge.Service {
+	exposed := strconv.Itoa(port)
+	return &bridge.Service{
+		ID:    bridge.Hostname + ":" + container + ":" + exposed,
+		Name:  name,
+		Port:  port,
+		IP:    "127.0.0.1",
+		Tags:  []string{"adaptertest"},
+		Attrs: map[string]string{},
+		Origin: bridge.ServicePort{
+			HostPort:          exposed,
+			HostIP:            "127.0.0.1",
+			ExposedPort:       exposed,
+			ExposedIP:         "127.0.0.1",
+			PortType:          "tcp",
+			ContainerID:       container + "0123456789abcdef",
+			ContainerHostname: container,
+			ContainerName:     container,
+		},
+	}
+}
+
+// Run executes the conformance suite against adapter as subtests of t.
+func Run(t *testing.T, adapter bridge.RegistryAdapter, opts Options) {
+	s := &suite{adapter: adapter, opts: opts}
+	if s.opts.Lookup == nil {
+		if !s.opts.Services {
+			t.Fatal("adaptertest: Options.Lookup is required when Services() is unsupported")
+		}
+		s.opts.Lookup = s.lookupServices
+	}
+	if s.opts.ExpiryTimeout == 0 {
+		s.opts.ExpiryTimeout = DefaultExpiryTimeout
+	}
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T)
+	}{
+		{"Ping", s.testPing},
+		{"Register", s.testRegister},
+		{"IdempotentRegister", s.testIdempotentRegister},
+		{"Refresh", s.testRefresh},
+		{"Deregister", s.testDeregister},
+		{"MultiInstance", s.testMultiInstance},
+		{"MultiPort", s.testMultiPort},
+		{"Services", s.testServices},
+		{"Expiry", s.testExpiry},
+	}
+	for _, test := range tests {
+		if s.skipped(test.name) {
+			t.Run(test.name, func(t *testing.T) {
+				t.Skip("skipped by adapter options")
+			})
+			continue
+		}
+		t.Run(test.name, test.fn)
+	}
+}
+
+type suite struct {
+	adapter bridge.RegistryAdapter
+	opts    Options
+}
+
+func (s *suite) skipped(name string) bool {
+	for _, skip := range s.opts.Skip {
+		if name == skip {
+			return true
+		}
+	}
+	return false
+}
+
+// service returns a fresh service with a name unique to this run.
+func (s *suite) service(port int) *bridge.Service {
+	n := atomic.AddInt64(&sequence, 1)
+	name := fmt.Sprintf("adaptertest-%d-%d", time.Now().UnixNano()%1e6, n)
+	return NewService(name, name, port)
+}
+
+func (s *suite) lookupServices(service *bridge.Service) (bool, error) {
+	found, err := s.find(service.ID)
+	return len(found) > 0, err
+}
+
+func (s *suite) find(id string) ([]*bridge.Service, error) {
+	services, err := s.adapter.Services()
+	if err != nil {
+		return nil, err
+	}
+	var found []*bridge.Service
+	for _, service := range services {
+		if service.ID == id {
+			found = append(found, service)
+		}
+	}
+	return found, nil
+}
+
+func (s *suite) register(t *testing.T, service *bridge.Service) {
+	if err := s.adapter.Register(service); err != nil {
+		t.Fatalf("register %s: %v", service.ID, err)
+	}
+}
+
+// cleanup removes a service a test registered. Errors are ignored since the
+// test may already have deregistered it.
+func (s *suite) cleanup(service *bridge.Service) {
+	s.adapter.Deregister(service)
+}
+
+func (s *suite) expectPresent(t *testing.T, service *bridge.Service, want bool) {
+	found, err := s.opts.Lookup(service)
+	if err != nil {
+		t.Fatalf("lookup %s: %v", service.ID, err)
+	}
+	if found != want {
+		if want {
+			t.Fatalf("%s: expected registration to be present", service.ID)
+		}
+		t.Fatalf("%s: expected registration to be absent", service.ID)
+	}
+}
+
+func (s *suite) testPing(t *testing.T) {
+	if err := s.adapter.Ping(); err != nil {
+		t.Fatal("ping:", err)
+	}
+}
+
+func (s *suite) testRegister(t *testing.T) {
+	service := s.service(8080)
+	s.register(t, service)
+	defer s.cleanup(service)
+	s.expectPresent(t, service, true)
+}
+
+func (s *suite) testIdempotentRegister(t *testing.T) {
+	service := s.service(8080)
+	s.register(t, service)
+	defer s.cleanup(service)
+	s.register(t, service)
+	s.expectPresent(t, service, true)
+
+	if s.opts.Services {
+		found, err := s.find(service.ID)
+		if err != nil {
+			t.Fatal("services:", err)
+		}
+		if len(found) != 1 {
+			t.Fatalf("%s: expected 1 registration after re-register, got %d", service.ID, len(found))
+		}
+	}
+}
+
+func (s *suite) testRefresh(t *testing.T) {
+	service := s.service(8080)
+	if s.opts.Expiry {
+		service.TTL = 2
+	}
+	s.register(t, service)
+	defer s.cleanup(service)
+
+	// Refresh at half the TTL for longer than the TTL itself; the
+	// registration must survive throughout.
+	for i := 0; i < 4; i++ {
+		if err := s.adapter.Refresh(service); err != nil {
+			t.Fatalf("refresh %s: %v", service.ID, err)
+		}
+		if s.opts.Expiry {
+			time.Sleep(time.Second)
+		}
+	}
+	s.expectPresent(t, service, true)
+}
+
+func (s *suite) testDeregister(t *testing.T) {
+	service := s.service(8080)
+	s.register(t, service)
+	s.expectPresent(t, service, true)
+	if err := s.adapter.Deregister(service); err != nil {
+		t.Fatalf("deregister %s: %v", service.ID, err)
+	}
+	s.expectPresent(t, service, false)
+}
+
+func (s *suite) testMultiInstance(t *testing.T) {
+	first := s.service(8080)
+	second := NewService(first.Name, first.Name+"-2", 8080)
+	second.Port = 8081
+
+	s.register(t, first)
+	defer s.cleanup(first)
+	s.register(t, second)
+	defer s.cleanup(second)
+	s.expectPresent(t, first, true)
+	s.expectPresent(t, second, true)
+
+	if err := s.adapter.Deregister(second); err != nil {
+		t.Fatalf("deregister %s: %v", second.ID, err)
+	}
+	s.expectPresent(t, first, true)
+	s.expectPresent(t, second, false)
+}
+
+func (s *suite) testMultiPort(t *testing.T) {
+	base := s.service(80)
+	plain := NewService(base.Name+"-80", base.Name, 80)
+	secure := NewService(base.Name+"-443", base.Name, 443)
+
+	s.register(t, plain)
+	defer s.cleanup(plain)
+	s.register(t, secure)
+	defer s.cleanup(secure)
+	s.expectPresent(t, plain, true)
+	s.expectPresent(t, secure, true)
+
+	if err := s.adapter.Deregister(secure); err != nil {
+		t.Fatalf("deregister %s: %v", secure.ID, err)
+	}
+	s.expectPresent(t, plain, true)
+	s.expectPresent(t, secure, false)
+}
+
+func (s *suite) testServices(t *testing.T) {
+	if !s.opts.Services {
+		t.Skip("adapter does not implement Services()")
+	}
+	service := s.service(8080)
+	service.Tags = []string{"adaptertest", "roundtrip"}
+	s.register(t, service)
+	defer s.cleanup(service)
+
+	found, err := s.find(service.ID)
+	if err != nil {
+		t.Fatal("services:", err)
+	}
+	if len(found) != 1 {
+		t.Fatalf("%s: expected 1 service, got %d", service.ID, len(found))
+	}
+	got := found[0]
+	if got.Name != service.Name {
+		t.Errorf("name: got %q, want %q", got.Name, service.Name)
+	}
+	if got.IP != service.IP {
+		t.Errorf("ip: got %q, want %q", got.IP, service.IP)
+	}
+	if got.Port != service.Port {
+		t.Errorf("port: got %d, want %d", got.Port, service.Port)
+	}
+	if s.opts.Tags && fmt.Sprint(got.Tags) != fmt.Sprint(service.Tags) {
+		t.Errorf("tags: got %v, want %v", got.Tags, service.Tags)
+	}
+}
+
+func (s *suite) testExpiry(t *testing.T) {
+	if !s.opts.Expiry {
+		t.Skip("backend does not expire registrations")
+	}
+	service := s.service(8080)
+	service.TTL = 1
+	s.register(t, service)
+	defer s.cleanup(service)
+	s.expectPresent(t, service, true)
+
+	deadline := time.Now().Add(s.opts.ExpiryTimeout)
+	for time.Now().Before(deadline) {
+		found, err := s.opts.Lookup(service)
+		if err != nil {
+			t.Fatalf("lookup %s: %v", service.ID, err)
+		}
+		if !found {
+			return
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	t.Fatalf("%s: registration still present %s after its TTL", service.ID, s.opts.ExpiryTimeout)
+}
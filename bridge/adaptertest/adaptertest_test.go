@@ -0,0 +1,72 @@
+package adaptertest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/registrator/bridge"
+)
+
+// memoryAdapter is a minimal in-process registry used to check the suite
+// itself.
+type memoryAdapter struct {
+	sync.Mutex
+	services map[string]*bridge.Service
+	expires  map[string]time.Time
+}
+
+func newMemoryAdapter() *memoryAdapter {
+	return &memoryAdapter{
+		services: make(map[string]*bridge.Service),
+		expires:  make(map[string]time.Time),
+	}
+}
+
+func (m *memoryAdapter) Ping() error {
+	return nil
+}
+
+func (m *memoryAdapter) Register(service *bridge.Service) error {
+	m.Lock()
+	defer m.Unlock()
+	m.services[service.ID] = service
+	if service.TTL > 0 {
+		m.expires[service.ID] = time.Now().Add(time.Duration(service.TTL) * time.Second)
+	}
+	return nil
+}
+
+func (m *memoryAdapter) Deregister(service *bridge.Service) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.services, service.ID)
+	delete(m.expires, service.ID)
+	return nil
+}
+
+func (m *memoryAdapter) Refresh(service *bridge.Service) error {
+	return m.Register(service)
+}
+
+func (m *memoryAdapter) Services() ([]*bridge.Service, error) {
+	m.Lock()
+	defer m.Unlock()
+	out := make([]*bridge.Service, 0, len(m.services))
+	for id, service := range m.services {
+		if expires, ok := m.expires[id]; ok && time.Now().After(expires) {
+			continue
+		}
+		out = append(out, service)
+	}
+	return out, nil
+}
+
+func TestMemoryAdapter(t *testing.T) {
+	Run(t, newMemoryAdapter(), Options{
+		Services:      true,
+		Tags:          true,
+		Expiry:        true,
+		ExpiryTimeout: 3 * time.Second,
+	})
+}
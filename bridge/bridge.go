@@ -2,6 +2,7 @@ package bridge
 
 import (
 	"errors"
+	"io"
 	"log"
 	"net"
 	"net/url"
@@ -11,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	dockerapi "github.com/fsouza/go-dockerclient"
 )
@@ -33,10 +35,10 @@ func New(docker *dockerapi.Client, adapterUri string, config Config) (*Bridge, e
 	}
 	factory, found := AdapterFactories.Lookup(uri.Scheme)
 	if !found {
-		return nil, errors.New("unrecognized adapter: " + adapterUri)
+		return nil, errors.New("unrecognized adapter: " + redact(uri))
 	}
 
-	log.Println("Using", uri.Scheme, "adapter:", uri)
+	log.Println("Using", uri.Scheme, "adapter:", redact(uri))
 	return &Bridge{
 		docker:         docker,
 		config:         config,
@@ -65,6 +67,8 @@ func (b *Bridge) RemoveOnExit(containerId string) {
 }
 
 func (b *Bridge) Refresh() {
+	containers := b.inspectForHealth()
+
 	b.Lock()
 	defer b.Unlock()
 
@@ -76,6 +80,12 @@ func (b *Bridge) Refresh() {
 	}
 
 	for containerId, services := range b.services {
+		// pick up changes to the container's health, which adapters may report
+		if container := containers[containerId]; container != nil {
+			for _, service := range services {
+				service.Origin.container = container
+			}
+		}
 		for _, service := range services {
 			err := b.registry.Refresh(service)
 			if err != nil {
@@ -87,6 +97,101 @@ func (b *Bridge) Refresh() {
 	}
 }
 
+// inspectForHealth inspects the containers with services if the adapter
+// reports their health. It doesn't hold the lock while waiting on Docker.
+func (b *Bridge) inspectForHealth() map[string]*dockerapi.Container {
+	reporter, ok := b.registry.(HealthReporter)
+	if !ok || !reporter.ReportsHealth() {
+		return nil
+	}
+
+	b.Lock()
+	ids := make([]string, 0, len(b.services))
+	for containerId := range b.services {
+		ids = append(ids, containerId)
+	}
+	b.Unlock()
+
+	containers := make(map[string]*dockerapi.Container, len(ids))
+	for _, containerId := range ids {
+		if container, err := b.docker.InspectContainer(containerId); err == nil {
+			containers[containerId] = container
+		}
+	}
+	return containers
+}
+
+// Close releases what the adapter holds on to, if it is an io.Closer.
+func (b *Bridge) Close() error {
+	if closer, ok := b.registry.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Watch re-registers owned services as soon as the adapter reports they
+// were removed from the backend, instead of waiting for the next resync. It
+// returns straight away if the adapter isn't a Watcher, and otherwise runs
+// until quit is closed.
+func (b *Bridge) Watch(quit <-chan struct{}) {
+	watcher, ok := b.registry.(Watcher)
+	if !ok {
+		return
+	}
+	log.Println("Watching backend for removed services ...")
+
+	removed := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			err := watcher.Watch(removed, quit)
+			if err == nil {
+				return
+			}
+			log.Println("watch failed, retrying:", err)
+			select {
+			case <-time.After(watchRetryInterval):
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case id := <-removed:
+			b.restore(id)
+		case <-done:
+			return
+		}
+	}
+}
+
+var watchRetryInterval = 5 * time.Second
+
+// restore re-registers an owned service that was removed from the backend.
+// IDs the bridge doesn't own, e.g. services it has just deregistered, are
+// ignored.
+func (b *Bridge) restore(id string) {
+	b.Lock()
+	defer b.Unlock()
+
+	for containerId, services := range b.services {
+		for _, service := range services {
+			if service.ID != id {
+				continue
+			}
+			err := b.registry.Register(service)
+			if err != nil {
+				log.Println("restore failed:", service.ID, err)
+				continue
+			}
+			log.Println("restored:", containerId[:12], service.ID)
+		}
+	}
+}
+
 func (b *Bridge) Sync(quiet bool) {
 	b.Lock()
 	defer b.Unlock()
@@ -193,6 +298,7 @@ func (b *Bridge) add(containerId string, quiet bool) {
 		return
 	}
 
+	var services []*Service
 	for _, port := range ports {
 		if b.config.Internal != true && port.HostPort == "" {
 			if !quiet {
@@ -207,6 +313,13 @@ func (b *Bridge) add(containerId string, quiet bool) {
 			}
 			continue
 		}
+		services = append(services, service)
+	}
+
+	for _, service := range services {
+		service.Origin.ContainerServices = services
+	}
+	for _, service := range services {
 		err := b.registry.Register(service)
 		if err != nil {
 			log.Println("register failed:", service, err)
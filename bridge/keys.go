@@ -0,0 +1,276 @@
+package bridge
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultKeyLayout is the key layout of the key-value backends, below their
+// path.
+const DefaultKeyLayout = "{name}/{id}"
+
+var keyPlaceholder = regexp.MustCompile(`\{([a-z_]+(?:\.[^{}/]+)?)\}`)
+
+// KeyTemplate renders the keys key-value backends store services under from
+// a layout such as "{attr.env}/{name}/{hostname}/{port}", and parses them back so
+// a backend can list what it stored. The placeholders are {name}, {id}, {ip},
+// {port}, {hostname}, {protocol}, {exposed_port}, {container_id},
+// {container_name} and {attr.<name>} for a service attribute. A layout that
+// ends in {attr} stores one key per field of the service instead of one key
+// per service.
+type KeyTemplate struct {
+	layout  string
+	fields  []string
+	pattern *regexp.Regexp
+}
+
+// NewKeyTemplate parses a key layout. An empty layout is DefaultKeyLayout.
+func NewKeyTemplate(layout string) (*KeyTemplate, error) {
+	layout = strings.Trim(layout, "/")
+	if layout == "" {
+		layout = DefaultKeyLayout
+	}
+	t := &KeyTemplate{layout: layout}
+	pattern := "^"
+	last := 0
+	for _, m := range keyPlaceholder.FindAllStringSubmatchIndex(layout, -1) {
+		field := layout[m[2]:m[3]]
+		if !knownKeyField(field) {
+			return nil, errors.New("unknown placeholder in key layout: {" + field + "}")
+		}
+		if field == "attr" && m[1] != len(layout) {
+			return nil, errors.New("{attr} must end the key layout")
+		}
+		pattern += regexp.QuoteMeta(layout[last:m[0]]) + "([^/]*)"
+		t.fields = append(t.fields, field)
+		last = m[1]
+	}
+	pattern += regexp.QuoteMeta(layout[last:]) + "$"
+	t.pattern = regexp.MustCompile(pattern)
+	return t, nil
+}
+
+func knownKeyField(field string) bool {
+	switch field {
+	case "name", "id", "ip", "port", "hostname", "protocol", "exposed_port",
+		"container_id", "container_name", "attr":
+		return true
+	}
+	return strings.HasPrefix(field, "attr.")
+}
+
+func (t *KeyTemplate) String() string {
+	return t.layout
+}
+
+// PerAttribute reports whether the layout stores one key per field of a
+// service, i.e. ends in {attr}.
+func (t *KeyTemplate) PerAttribute() bool {
+	return len(t.fields) > 0 && t.fields[len(t.fields)-1] == "attr"
+}
+
+// HasID reports whether a service's ID can be recovered from its keys, from
+// an {id} placeholder or, for per-attribute layouts, the id key.
+func (t *KeyTemplate) HasID() bool {
+	for _, field := range t.fields {
+		if field == "id" || field == "attr" {
+			return true
+		}
+	}
+	return false
+}
+
+// Key renders the key of a service. For per-attribute layouts it is the
+// common prefix of the service's keys.
+func (t *KeyTemplate) Key(service *Service) string {
+	key := keyPlaceholder.ReplaceAllStringFunc(t.layout, func(placeholder string) string {
+		field := placeholder[1 : len(placeholder)-1]
+		if field == "attr" {
+			return ""
+		}
+		return keyField(service, field)
+	})
+	return strings.TrimSuffix(key, "/")
+}
+
+// AttributeKeys renders the keys of a service with a per-attribute layout,
+// mapped to their values. Besides its attributes a service has the keys id,
+// name, ip, port and tags.
+func (t *KeyTemplate) AttributeKeys(service *Service) map[string]string {
+	prefix := t.Key(service) + "/"
+	keys := map[string]string{
+		prefix + "id":   service.ID,
+		prefix + "name": service.Name,
+		prefix + "ip":   service.IP,
+		prefix + "port": strconv.Itoa(service.Port),
+		prefix + "tags": strings.Join(service.Tags, ","),
+	}
+	for k, v := range service.Attrs {
+		if _, ok := keys[prefix+k]; !ok {
+			keys[prefix+k] = v
+		}
+	}
+	return keys
+}
+
+// Parse returns the service a key was rendered from, with the fields the
+// layout has placeholders for. For per-attribute layouts field is the key's
+// {attr} segment. It fails for keys that don't fit the layout.
+func (t *KeyTemplate) Parse(key string) (service *Service, field string, ok bool) {
+	m := t.pattern.FindStringSubmatch(strings.Trim(key, "/"))
+	if m == nil {
+		return nil, "", false
+	}
+	service = &Service{Attrs: make(map[string]string)}
+	for i, name := range t.fields {
+		value := m[i+1]
+		switch name {
+		case "name":
+			service.Name = value
+		case "id":
+			service.ID = value
+		case "ip":
+			service.IP = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, "", false
+			}
+			service.Port = port
+		case "protocol":
+			service.Origin.PortType = value
+		case "exposed_port":
+			service.Origin.ExposedPort = value
+		case "container_id":
+			service.Origin.ContainerID = value
+		case "container_name":
+			service.Origin.ContainerName = value
+		case "attr":
+			field = value
+		case "hostname":
+		default:
+			service.Attrs[strings.TrimPrefix(name, "attr.")] = value
+		}
+	}
+	return service, field, true
+}
+
+// Collect rebuilds services from the keys a per-attribute layout stored and
+// their values. Keys that don't fit the layout, and services without an ID,
+// are skipped.
+func (t *KeyTemplate) Collect(values map[string]string) []*Service {
+	byKey := make(map[string]*Service)
+	var order []string
+	for key, value := range values {
+		parsed, field, ok := t.Parse(key)
+		if !ok || field == "" {
+			continue
+		}
+		prefix := strings.TrimSuffix(strings.Trim(key, "/"), "/"+field)
+		service, seen := byKey[prefix]
+		if !seen {
+			service = parsed
+			byKey[prefix] = service
+			order = append(order, prefix)
+		}
+		switch field {
+		case "id":
+			service.ID = value
+		case "name":
+			service.Name = value
+		case "ip":
+			service.IP = value
+		case "port":
+			service.Port, _ = strconv.Atoi(value)
+		case "tags":
+			if value != "" {
+				service.Tags = strings.Split(value, ",")
+			}
+		default:
+			service.Attrs[field] = value
+		}
+	}
+
+	out := make([]*Service, 0, len(order))
+	for _, prefix := range order {
+		if byKey[prefix].ID != "" {
+			out = append(out, byKey[prefix])
+		}
+	}
+	return out
+}
+
+// ServiceRecord is the value key-value backends store for a service with
+// their JSON format.
+type ServiceRecord struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	IP          string            `json:"ip"`
+	Port        int               `json:"port"`
+	Protocol    string            `json:"protocol"`
+	Tags        []string          `json:"tags"`
+	Attrs       map[string]string `json:"attrs"`
+	TTL         int               `json:"ttl,omitempty"`
+	ContainerID string            `json:"container_id"`
+	ExposedPort string            `json:"exposed_port"`
+}
+
+// NewServiceRecord returns the record of a service.
+func NewServiceRecord(service *Service) *ServiceRecord {
+	return &ServiceRecord{
+		ID:          service.ID,
+		Name:        service.Name,
+		IP:          service.IP,
+		Port:        service.Port,
+		Protocol:    service.Origin.PortType,
+		Tags:        service.Tags,
+		Attrs:       service.Attrs,
+		TTL:         service.TTL,
+		ContainerID: service.Origin.ContainerID,
+		ExposedPort: service.Origin.ExposedPort,
+	}
+}
+
+// Service returns the service a record was stored for.
+func (r *ServiceRecord) Service() *Service {
+	return &Service{
+		ID:    r.ID,
+		Name:  r.Name,
+		IP:    r.IP,
+		Port:  r.Port,
+		Tags:  r.Tags,
+		Attrs: r.Attrs,
+		TTL:   r.TTL,
+		Origin: ServicePort{
+			PortType:    r.Protocol,
+			ContainerID: r.ContainerID,
+			ExposedPort: r.ExposedPort,
+		},
+	}
+}
+
+func keyField(service *Service, field string) string {
+	switch field {
+	case "name":
+		return service.Name
+	case "id":
+		return service.ID
+	case "ip":
+		return service.IP
+	case "port":
+		return strconv.Itoa(service.Port)
+	case "hostname":
+		return Hostname
+	case "protocol":
+		return service.Origin.PortType
+	case "exposed_port":
+		return service.Origin.ExposedPort
+	case "container_id":
+		return service.Origin.ContainerID
+	case "container_name":
+		return service.Origin.ContainerName
+	}
+	return service.Attrs[strings.TrimPrefix(field, "attr.")]
+}
@@ -0,0 +1,103 @@
+package bridge
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyTemplate(t *testing.T) {
+	service := &Service{
+		ID:    "host:web-1:80",
+		Name:  "web",
+		IP:    "10.0.0.1",
+		Port:  32768,
+		Tags:  []string{"a", "b"},
+		Attrs: map[string]string{"env": "prod"},
+	}
+
+	tmpl, err := NewKeyTemplate("")
+	assert.NoError(t, err)
+	assert.Equal(t, "web/host:web-1:80", tmpl.Key(service))
+	assert.True(t, tmpl.HasID())
+
+	tmpl, err = NewKeyTemplate("/{attr.env}/{name}/{ip}/{port}/")
+	assert.NoError(t, err)
+	assert.False(t, tmpl.PerAttribute())
+	assert.False(t, tmpl.HasID())
+	key := tmpl.Key(service)
+	assert.Equal(t, "prod/web/10.0.0.1/32768", key)
+	parsed, _, ok := tmpl.Parse("/" + key)
+	assert.True(t, ok)
+	assert.Equal(t, "web", parsed.Name)
+	assert.Equal(t, "10.0.0.1", parsed.IP)
+	assert.Equal(t, 32768, parsed.Port)
+	assert.Equal(t, map[string]string{"env": "prod"}, parsed.Attrs)
+	_, _, ok = tmpl.Parse("prod/web/10.0.0.1")
+	assert.False(t, ok)
+	_, _, ok = tmpl.Parse("prod/web/10.0.0.1/http")
+	assert.False(t, ok)
+
+	_, err = NewKeyTemplate("{name}/{nope}")
+	assert.Error(t, err)
+	_, err = NewKeyTemplate("{attr}/{name}")
+	assert.Error(t, err)
+}
+
+func TestKeyTemplatePerAttribute(t *testing.T) {
+	tmpl, err := NewKeyTemplate("{name}/{id}/{attr}")
+	assert.NoError(t, err)
+	assert.True(t, tmpl.PerAttribute())
+
+	service := &Service{
+		ID:    "host:web-1:80",
+		Name:  "web",
+		IP:    "10.0.0.1",
+		Port:  32768,
+		Tags:  []string{"a", "b"},
+		Attrs: map[string]string{"env": "prod"},
+	}
+	assert.Equal(t, "web/host:web-1:80", tmpl.Key(service))
+	keys := tmpl.AttributeKeys(service)
+	assert.Equal(t, map[string]string{
+		"web/host:web-1:80/id":   "host:web-1:80",
+		"web/host:web-1:80/name": "web",
+		"web/host:web-1:80/ip":   "10.0.0.1",
+		"web/host:web-1:80/port": "32768",
+		"web/host:web-1:80/tags": "a,b",
+		"web/host:web-1:80/env":  "prod",
+	}, keys)
+
+	keys["other/key"] = "ignored"
+	services := tmpl.Collect(keys)
+	if assert.Len(t, services, 1) {
+		assert.Equal(t, service, services[0])
+	}
+}
+
+func TestServiceRecord(t *testing.T) {
+	service := &Service{
+		ID:    "host:web-1:80",
+		Name:  "web",
+		IP:    "10.0.0.5",
+		Port:  8080,
+		Tags:  []string{"a", "b"},
+		Attrs: map[string]string{"env": "prod"},
+		TTL:   30,
+		Origin: ServicePort{
+			PortType:    "tcp",
+			ContainerID: "abc123",
+			ExposedPort: "80",
+		},
+	}
+
+	value, err := json.Marshal(NewServiceRecord(service))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"host:web-1:80","name":"web","ip":"10.0.0.5","port":8080,"protocol":"tcp",
+		"tags":["a","b"],"attrs":{"env":"prod"},"ttl":30,"container_id":"abc123","exposed_port":"80"}`, string(value))
+
+	var record ServiceRecord
+	assert.NoError(t, json.Unmarshal(value, &record))
+	assert.Equal(t, service, record.Service())
+}
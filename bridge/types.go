@@ -19,6 +19,24 @@ type RegistryAdapter interface {
 	Services() ([]*Service, error)
 }
 
+// Watcher is an optional interface for adapters that can notice services
+// being removed from the backend by something other than Registrator.
+type Watcher interface {
+	// Watch sends the ID of every service removed from the backend on
+	// removed until stop is closed. It returns nil once stop is closed, or
+	// straight away if the backend can't be watched, and an error if the
+	// watch broke and should be retried.
+	Watch(removed chan<- string, stop <-chan struct{}) error
+}
+
+// HealthReporter is an optional interface for adapters whose Refresh reports
+// the container's Docker health status, see ServicePort.Health.
+type HealthReporter interface {
+	// ReportsHealth reports whether containers need to be inspected for
+	// their health before their services are refreshed.
+	ReportsHealth() bool
+}
+
 type Config struct {
 	HostIp          string
 	Internal        bool
@@ -55,5 +73,17 @@ type ServicePort struct {
 	ContainerHostname string
 	ContainerID       string
 	ContainerName     string
+	// the services of the container's published ports, this one included,
+	// as the bridge grouped them before registering them
+	ContainerServices []*Service
 	container         *dockerapi.Container
 }
+
+// Health returns the status of the container's Docker health check as of the
+// last refresh: starting, healthy or unhealthy, or "" if it has none.
+func (p ServicePort) Health() string {
+	if p.container == nil {
+		return ""
+	}
+	return p.container.State.Health.Status
+}
@@ -1,6 +1,7 @@
 package bridge
 
 import (
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -8,6 +9,30 @@ import (
 	dockerapi "github.com/fsouza/go-dockerclient"
 )
 
+// redact returns a registry URI for logging, with its password and the
+// values of any secret query parameters masked. Request headers, given as
+// header=<name>:<value>, keep their name.
+func redact(uri *url.URL) string {
+	redacted := *uri
+	query := uri.Query()
+	masked := false
+	for _, key := range []string{"token", "secret", "password"} {
+		if _, ok := query[key]; ok {
+			query.Set(key, "xxxxx")
+			masked = true
+		}
+	}
+	for i, header := range query["header"] {
+		name := strings.SplitN(header, ":", 2)[0]
+		query["header"][i] = name + ":xxxxx"
+		masked = true
+	}
+	if masked {
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.Redacted()
+}
+
 func retry(fn func() error) error {
 	return backoff.Retry(fn, backoff.NewExponentialBackOff())
 }
@@ -74,8 +99,10 @@ func servicePort(container *dockerapi.Container, port dockerapi.Port, published
 	//detect if container use overlay network, than set HostIP into NetworkSettings.Network[string].IPAddress
 	//better to use registrator with -internal flag
 	nm = container.HostConfig.NetworkMode
-	if nm != "bridge" || nm != "default" || nm != "host" {
-		hip = container.NetworkSettings.Networks[nm].IPAddress
+	if nm != "bridge" && nm != "default" && nm != "host" {
+		if network, ok := container.NetworkSettings.Networks[nm]; ok && network.IPAddress != "" {
+			hip = network.IPAddress
+		}
 	}
 
 	exposedPort := strings.Split(string(port), "/")
@@ -102,6 +129,7 @@ func servicePort(container *dockerapi.Container, port dockerapi.Port, published
 		PortType:          ept,
 		ContainerID:       container.ID,
 		ContainerHostname: container.Config.Hostname,
+		ContainerName:     strings.TrimPrefix(container.Name, "/"),
 		container:         container,
 	}
 }
@@ -0,0 +1,39 @@
+package bridge
+
+import (
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServicePortHostIP(t *testing.T) {
+	published := []dockerapi.PortBinding{{HostIP: "192.168.1.10", HostPort: "8080"}}
+	container := &dockerapi.Container{
+		ID:         "abc123",
+		Name:       "/web-1",
+		Config:     &dockerapi.Config{Hostname: "web-1"},
+		HostConfig: &dockerapi.HostConfig{},
+		NetworkSettings: &dockerapi.NetworkSettings{
+			IPAddress: "172.17.0.2",
+			Networks: map[string]dockerapi.ContainerNetwork{
+				"bridge": {IPAddress: "172.17.0.2"},
+			},
+		},
+	}
+
+	// the published host IP in Docker's own network modes
+	for _, mode := range []string{"bridge", "default", "host"} {
+		container.HostConfig.NetworkMode = mode
+		assert.Equal(t, "192.168.1.10", servicePort(container, "80/tcp", published).HostIP, mode)
+	}
+
+	// the container's IP on a user defined or overlay network
+	container.HostConfig.NetworkMode = "overlay"
+	container.NetworkSettings.Networks["overlay"] = dockerapi.ContainerNetwork{IPAddress: "10.0.0.5"}
+	assert.Equal(t, "10.0.0.5", servicePort(container, "80/tcp", published).HostIP)
+
+	// unless the container isn't attached to a network of that name
+	container.HostConfig.NetworkMode = "container:db-1"
+	assert.Equal(t, "192.168.1.10", servicePort(container, "80/tcp", published).HostIP)
+}
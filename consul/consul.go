@@ -1,16 +1,28 @@
 package consul
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gliderlabs/registrator/bridge"
 	consulapi "github.com/hashicorp/consul/api"
 )
 
-const DefaultInterval = "10s"
+const (
+	DefaultInterval     = "10s"
+	TokenReloadInterval = 30 * time.Second
+)
 
 func init() {
 	f := new(Factory)
@@ -27,21 +39,161 @@ func (r *ConsulAdapter) interpolateService(script string, service *bridge.Servic
 type Factory struct{}
 
 func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	query := uri.Query()
 	config := consulapi.DefaultConfig()
 	if uri.Scheme == "consul-unix" {
-		config.Address = strings.TrimPrefix(uri.String(), "consul-")
+		socket := *uri
+		socket.RawQuery = ""
+		config.Address = strings.TrimPrefix(socket.String(), "consul-")
 	} else if uri.Host != "" {
 		config.Address = uri.Host
 	}
+
+	if dc := query.Get("datacenter"); dc != "" {
+		config.Datacenter = dc
+	}
+	if namespace := query.Get("namespace"); namespace != "" {
+		config.Namespace = namespace
+	}
+	if partition := query.Get("partition"); partition != "" {
+		config.Partition = partition
+	}
+	if token := query.Get("token"); token != "" {
+		config.Token = token
+	}
+	tokenFile := query.Get("token-file")
+	if tokenFile != "" {
+		// sent as a header instead, so it can be reloaded
+		config.Token = ""
+		config.TokenFile = ""
+	}
+
+	if ca := query.Get("tls-ca"); ca != "" {
+		config.TLSConfig.CAFile = ca
+	}
+	if cert := query.Get("tls-cert"); cert != "" {
+		config.TLSConfig.CertFile = cert
+		config.TLSConfig.KeyFile = query.Get("tls-key")
+	}
+	if name := query.Get("tls-server-name"); name != "" {
+		config.TLSConfig.Address = name
+	}
+	if v := query.Get("tls-skip-verify"); v != "" {
+		skip, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatal("consul: invalid tls-skip-verify: ", v)
+		}
+		config.TLSConfig.InsecureSkipVerify = skip
+	}
+	if query.Get("tls-ca") != "" || query.Get("tls-cert") != "" || query.Get("tls") == "true" {
+		config.Scheme = "https"
+	}
+
 	client, err := consulapi.NewClient(config)
 	if err != nil {
-		log.Fatal("consul: ", uri.Scheme)
+		log.Fatal("consul: ", err)
+	}
+	adapter := &ConsulAdapter{
+		client:     client,
+		tokenFile:  tokenFile,
+		quit:       make(chan struct{}),
+		registered: make(map[string]*bridge.Service),
+		sidecars:   make(map[string][]*bridge.Service),
 	}
-	return &ConsulAdapter{client: client}
+	switch query.Get("mode") {
+	case "", "agent":
+	case "catalog":
+		adapter.node = query.Get("node")
+		if adapter.node == "" {
+			adapter.node = bridge.Hostname
+		}
+		adapter.nodeAddress = query.Get("node-address")
+		if adapter.nodeAddress == "" {
+			log.Fatal("consul: node-address required in catalog mode")
+		}
+	default:
+		log.Fatal("consul: unknown mode: ", query.Get("mode"))
+	}
+	if tokenFile != "" {
+		if _, err := adapter.loadToken(); err != nil {
+			log.Fatal("consul: unable to read token: ", err)
+		}
+		go adapter.reloadToken()
+	}
+	return adapter
 }
 
 type ConsulAdapter struct {
-	client *consulapi.Client
+	sync.Mutex
+	client    *consulapi.Client
+	tokenFile string
+	quit      chan struct{}
+
+	// registered services by ID, and Connect sidecar containers' services
+	// by the application they proxy for, in the order they were paired
+	registered map[string]*bridge.Service
+	sidecars   map[string][]*bridge.Service
+
+	// node registered in the catalog directly, without an agent, if set
+	node        string
+	nodeAddress string
+
+	// service IDs seen on this node by the last watch query
+	watched map[string]bool
+}
+
+// loadToken reads the ACL token from the token file, and reports whether it
+// changed.
+func (r *ConsulAdapter) loadToken() (bool, error) {
+	data, err := ioutil.ReadFile(r.tokenFile)
+	if err != nil {
+		return false, err
+	}
+	token := strings.TrimSpace(string(data))
+	headers := r.client.Headers()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	if headers.Get("X-Consul-Token") == token {
+		return false, nil
+	}
+	headers.Set("X-Consul-Token", token)
+	r.client.SetHeaders(headers)
+	return true, nil
+}
+
+// reloadToken picks up changes to the token file, e.g. from Vault rotating
+// the token, until the adapter is closed.
+func (r *ConsulAdapter) reloadToken() {
+	ticker := time.NewTicker(TokenReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-ticker.C:
+		}
+		changed, err := r.loadToken()
+		if err != nil {
+			log.Println("consul: failed to reload token:", err)
+			continue
+		}
+		if changed {
+			log.Println("consul: reloaded token from", r.tokenFile)
+		}
+	}
+}
+
+// Close stops reloading the token file. The bridge calls it on shutdown.
+func (r *ConsulAdapter) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	select {
+	case <-r.quit:
+	default:
+		close(r.quit)
+	}
+	return nil
 }
 
 // Ping will try to connect to consul by attempting to retrieve the current leader.
@@ -57,63 +209,452 @@ func (r *ConsulAdapter) Ping() error {
 }
 
 func (r *ConsulAdapter) Register(service *bridge.Service) error {
+	if app := service.Attrs["connect_sidecar_for"]; app != "" && r.node == "" {
+		return r.pairSidecar(app, service)
+	}
+
 	registration := new(consulapi.AgentServiceRegistration)
 	registration.ID = service.ID
 	registration.Name = service.Name
 	registration.Port = service.Port
 	registration.Tags = service.Tags
 	registration.Address = service.IP
-	registration.Check = r.buildCheck(service)
-	return r.client.Agent().ServiceRegister(registration)
+	registration.Meta = serviceMeta(service)
+	registration.TaggedAddresses = taggedAddresses(service)
+	registration.Weights = weights(service)
+	registration.EnableTagOverride, _ = strconv.ParseBool(service.Attrs["enable_tag_override"])
+	if r.node != "" {
+		return r.registerCatalog(registration)
+	}
+	registration.Checks = r.buildChecks(service)
+	registration.Connect = r.buildConnect(service)
+	if err := r.client.Agent().ServiceRegister(registration); err != nil {
+		return err
+	}
+	// TTL checks start out critical, so don't wait for the first refresh;
+	// the service is registered either way, and refreshes retry the update
+	if err := r.Refresh(service); err != nil {
+		log.Println("consul: failed to update TTL checks:", err)
+	}
+	return nil
+}
+
+// buildConnect returns the Connect configuration of a service: native, or
+// with a sidecar proxy registration if the service has upstreams, a sidecar
+// port, SERVICE_CONNECT_SIDECAR set, or a sidecar container paired with it.
+func (r *ConsulAdapter) buildConnect(service *bridge.Service) *consulapi.AgentServiceConnect {
+	r.Lock()
+	r.registered[service.ID] = service
+	sidecar := r.sidecarFor(service)
+	r.Unlock()
+
+	if native, _ := strconv.ParseBool(service.Attrs["connect_native"]); native {
+		return &consulapi.AgentServiceConnect{Native: true}
+	}
+	enabled, _ := strconv.ParseBool(service.Attrs["connect_sidecar"])
+	port, _ := strconv.Atoi(service.Attrs["connect_sidecar_port"])
+	upstreams := parseUpstreams(service.Attrs["connect_upstreams"])
+	if !enabled && port == 0 && len(upstreams) == 0 && sidecar == nil {
+		return nil
+	}
+
+	// Consul picks a port for the sidecar if none is given
+	registration := &consulapi.AgentServiceRegistration{Port: port}
+	if sidecar != nil {
+		registration.Address = sidecar.IP
+		registration.Port = sidecar.Port
+	}
+	if len(upstreams) > 0 {
+		registration.Proxy = &consulapi.AgentServiceConnectProxyConfig{Upstreams: upstreams}
+	}
+	return &consulapi.AgentServiceConnect{SidecarService: registration}
 }
 
-func (r *ConsulAdapter) buildCheck(service *bridge.Service) *consulapi.AgentServiceCheck {
+// parseUpstreams parses SERVICE_CONNECT_UPSTREAMS, a comma separated list of
+// <service>:<local bind port>.
+func parseUpstreams(v string) []consulapi.Upstream {
+	var upstreams []consulapi.Upstream
+	for _, upstream := range strings.Split(v, ",") {
+		if upstream = strings.TrimSpace(upstream); upstream == "" {
+			continue
+		}
+		parts := strings.SplitN(upstream, ":", 2)
+		if len(parts) != 2 {
+			log.Println("consul: ignoring upstream without local bind port:", upstream)
+			continue
+		}
+		port, err := strconv.Atoi(parts[1])
+		if err != nil {
+			log.Println("consul: ignoring upstream with invalid local bind port:", upstream)
+			continue
+		}
+		upstreams = append(upstreams, consulapi.Upstream{DestinationName: parts[0], LocalBindPort: port})
+	}
+	return upstreams
+}
+
+// pairSidecar makes a sidecar proxy container's service, e.g. Envoy's, the
+// sidecar of the application's services, registering them again with its
+// address and port. The application is a container name, or
+// <container>:<service name> for one of its services. The proxy's own service
+// isn't registered, as Consul registers the sidecar along with the
+// application's service. Of several sidecars for the same application, the
+// one paired first is used.
+func (r *ConsulAdapter) pairSidecar(app string, sidecar *bridge.Service) error {
+	r.Lock()
+	paired := false
+	for i, s := range r.sidecars[app] {
+		if s.ID == sidecar.ID {
+			r.sidecars[app][i] = sidecar
+			paired = true
+		}
+	}
+	if !paired {
+		r.sidecars[app] = append(r.sidecars[app], sidecar)
+	}
+	r.Unlock()
+	return r.registerApp(app)
+}
+
+func (r *ConsulAdapter) unpairSidecar(app string, sidecar *bridge.Service) error {
+	r.Lock()
+	sidecars := r.sidecars[app]
+	for i, s := range sidecars {
+		if s.ID != sidecar.ID {
+			continue
+		}
+		if len(sidecars) == 1 {
+			delete(r.sidecars, app)
+		} else {
+			r.sidecars[app] = append(sidecars[:i:i], sidecars[i+1:]...)
+		}
+		r.Unlock()
+		if i > 0 {
+			// not the sidecar in use
+			return nil
+		}
+		return r.registerApp(app)
+	}
+	r.Unlock()
+	return nil
+}
+
+// sidecarFor returns the sidecar of a service, preferring one paired with
+// the service by name to one paired with its whole container. It must be
+// called with the adapter locked.
+func (r *ConsulAdapter) sidecarFor(service *bridge.Service) *bridge.Service {
+	container := service.Origin.ContainerName
+	for _, app := range []string{container + ":" + service.Name, container} {
+		if sidecars := r.sidecars[app]; len(sidecars) > 0 {
+			return sidecars[0]
+		}
+	}
+	return nil
+}
+
+// registerApp registers the services of an application again.
+func (r *ConsulAdapter) registerApp(app string) error {
+	container, name := app, ""
+	if i := strings.Index(app, ":"); i >= 0 {
+		container, name = app[:i], app[i+1:]
+	}
+	r.Lock()
+	var services []*bridge.Service
+	for _, service := range r.registered {
+		if service.Origin.ContainerName == container && (name == "" || service.Name == name) {
+			services = append(services, service)
+		}
+	}
+	r.Unlock()
+
+	for _, service := range services {
+		if err := r.Register(service); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerCatalog registers a service with the catalog directly, for hosts
+// without a Consul agent. Checks and Connect sidecars aren't registered, as
+// there is no agent to run them.
+func (r *ConsulAdapter) registerCatalog(registration *consulapi.AgentServiceRegistration) error {
+	service := &consulapi.AgentService{
+		ID:                registration.ID,
+		Service:           registration.Name,
+		Tags:              registration.Tags,
+		Port:              registration.Port,
+		Address:           registration.Address,
+		Meta:              registration.Meta,
+		TaggedAddresses:   registration.TaggedAddresses,
+		EnableTagOverride: registration.EnableTagOverride,
+	}
+	if registration.Weights != nil {
+		service.Weights = *registration.Weights
+	}
+	_, err := r.client.Catalog().Register(&consulapi.CatalogRegistration{
+		Node:    r.node,
+		Address: r.nodeAddress,
+		Service: service,
+	}, nil)
+	return err
+}
+
+// serviceMeta maps SERVICE_META_<key> attributes to service metadata.
+func serviceMeta(service *bridge.Service) map[string]string {
+	meta := make(map[string]string)
+	for k, v := range service.Attrs {
+		if strings.HasPrefix(k, "meta_") {
+			meta[strings.TrimPrefix(k, "meta_")] = v
+		}
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+}
+
+var addressTags = []string{"lan", "lan_ipv4", "lan_ipv6", "wan", "wan_ipv4", "wan_ipv6"}
+
+// taggedAddresses maps SERVICE_ADDRESS_<tag> attributes, each an address with
+// an optional port, to tagged addresses. The port defaults to the service's.
+func taggedAddresses(service *bridge.Service) map[string]consulapi.ServiceAddress {
+	addresses := make(map[string]consulapi.ServiceAddress)
+	for _, tag := range addressTags {
+		v := service.Attrs["address_"+tag]
+		if v == "" {
+			continue
+		}
+		address := consulapi.ServiceAddress{Address: strings.Trim(v, "[]"), Port: service.Port}
+		if host, port, err := net.SplitHostPort(v); err == nil {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				log.Println("consul: ignoring invalid tagged address:", v)
+				continue
+			}
+			address = consulapi.ServiceAddress{Address: host, Port: p}
+		}
+		addresses[tag] = address
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+	return addresses
+}
+
+// weights maps SERVICE_WEIGHTS_PASSING and SERVICE_WEIGHTS_WARNING to DNS SRV
+// weights. Either defaults to 1, as in Consul.
+func weights(service *bridge.Service) *consulapi.AgentWeights {
+	passing, warning := service.Attrs["weights_passing"], service.Attrs["weights_warning"]
+	if passing == "" && warning == "" {
+		return nil
+	}
+	return &consulapi.AgentWeights{Passing: weight(passing), Warning: weight(warning)}
+}
+
+func weight(v string) int {
+	if v == "" {
+		return 1
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Println("consul: ignoring invalid weight:", v)
+		return 1
+	}
+	return n
+}
+
+var checkIndex = regexp.MustCompile(`^check_([0-9]+)_`)
+
+// buildChecks returns the check configured with SERVICE_CHECK_* attributes,
+// followed by those configured with indexed SERVICE_CHECK_<n>_* attributes.
+func (r *ConsulAdapter) buildChecks(service *bridge.Service) consulapi.AgentServiceChecks {
+	var checks consulapi.AgentServiceChecks
+	if check := r.buildCheck(service, checkAttrs(service, "check_")); check != nil {
+		check.CheckID = "service:" + service.ID
+		checks = append(checks, check)
+	}
+
+	indexes := make(map[int]bool)
+	for k := range service.Attrs {
+		if m := checkIndex.FindStringSubmatch(k); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			indexes[n] = true
+		}
+	}
+	sorted := make([]int, 0, len(indexes))
+	for n := range indexes {
+		sorted = append(sorted, n)
+	}
+	sort.Ints(sorted)
+	for _, n := range sorted {
+		index := strconv.Itoa(n)
+		if check := r.buildCheck(service, checkAttrs(service, "check_"+index+"_")); check != nil {
+			check.CheckID = "service:" + service.ID + ":" + index
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
+
+// checkAttrs returns the service attributes starting with prefix, without it.
+func checkAttrs(service *bridge.Service, prefix string) map[string]string {
+	attrs := make(map[string]string)
+	for k, v := range service.Attrs {
+		if strings.HasPrefix(k, prefix) {
+			attrs[strings.TrimPrefix(k, prefix)] = v
+		}
+	}
+	return attrs
+}
+
+func (r *ConsulAdapter) buildCheck(service *bridge.Service, attrs map[string]string) *consulapi.AgentServiceCheck {
 	check := new(consulapi.AgentServiceCheck)
-	if path := service.Attrs["check_http"]; path != "" {
+	if path := attrs["http"]; path != "" {
 		check.HTTP = fmt.Sprintf("http://%s:%d%s", service.IP, service.Port, path)
-		if timeout := service.Attrs["check_timeout"]; timeout != "" {
-			check.Timeout = timeout
-		}
-	} else if cmd := service.Attrs["check_cmd"]; cmd != "" {
-		check.Script = fmt.Sprintf("check-cmd %s %s %s", service.Origin.ContainerID[:12], service.Origin.ExposedPort, cmd)
-	} else if script := service.Attrs["check_script"]; script != "" {
-		check.Script = r.interpolateService(script, service)
-	} else if ttl := service.Attrs["check_ttl"]; ttl != "" {
+	} else if path := attrs["https"]; path != "" {
+		check.HTTP = fmt.Sprintf("https://%s:%d%s", service.IP, service.Port, path)
+	} else if cmd := attrs["cmd"]; cmd != "" {
+		check.Args = shellArgs(fmt.Sprintf("check-cmd %s %s %s", service.Origin.ContainerID[:12], service.Origin.ExposedPort, cmd))
+	} else if script := attrs["script"]; script != "" {
+		check.Args = shellArgs(r.interpolateService(script, service))
+	} else if cmd := attrs["docker"]; cmd != "" {
+		check.DockerContainerID = service.Origin.ContainerID
+		check.Shell = attrs["shell"]
+		if check.Shell == "" {
+			check.Shell = "/bin/sh"
+		}
+		check.Args = []string{check.Shell, "-c", r.interpolateService(cmd, service)}
+	} else if ttl := attrs["ttl"]; ttl != "" {
 		check.TTL = ttl
-	} else if tcp := service.Attrs["check_tcp"]; tcp != "" {
+	} else if tcp := attrs["tcp"]; tcp != "" {
 		check.TCP = fmt.Sprintf("%s:%d", service.IP, service.Port)
-		if timeout := service.Attrs["check_timeout"]; timeout != "" {
-			check.Timeout = timeout
+	} else if grpc := attrs["grpc"]; grpc != "" {
+		check.GRPC = fmt.Sprintf("%s:%d", service.IP, service.Port)
+		if grpc != "true" {
+			// the gRPC service to check, rather than the whole server
+			check.GRPC += "/" + grpc
 		}
+		check.GRPCUseTLS, _ = strconv.ParseBool(attrs["grpc_use_tls"])
 	} else {
 		return nil
 	}
-	if check.Script != "" || check.HTTP != "" || check.TCP != "" {
-		if interval := service.Attrs["check_interval"]; interval != "" {
+
+	if check.HTTP != "" {
+		check.Method = attrs["method"]
+		for k, v := range attrs {
+			if strings.HasPrefix(k, "header_") {
+				if check.Header == nil {
+					check.Header = make(map[string][]string)
+				}
+				name := http.CanonicalHeaderKey(strings.Replace(strings.TrimPrefix(k, "header_"), "_", "-", -1))
+				check.Header[name] = append(check.Header[name], v)
+			}
+		}
+	}
+	if check.HTTP != "" || check.GRPC != "" {
+		check.TLSSkipVerify, _ = strconv.ParseBool(attrs["tls_skip_verify"])
+		check.TLSServerName = attrs["tls_server_name"]
+	}
+	if check.HTTP != "" || check.TCP != "" || check.GRPC != "" {
+		check.Timeout = attrs["timeout"]
+	}
+	if check.TTL == "" {
+		if interval := attrs["interval"]; interval != "" {
 			check.Interval = interval
 		} else {
 			check.Interval = DefaultInterval
 		}
 	}
+	check.Name = attrs["name"]
+	check.Notes = attrs["notes"]
+	check.Status = attrs["initial_status"]
+	check.DeregisterCriticalServiceAfter = attrs["deregister_after"]
 	return check
 }
 
+func shellArgs(cmd string) []string {
+	return []string{"/bin/sh", "-c", cmd}
+}
+
 func (r *ConsulAdapter) Deregister(service *bridge.Service) error {
+	if app := service.Attrs["connect_sidecar_for"]; app != "" && r.node == "" {
+		return r.unpairSidecar(app, service)
+	}
+	r.Lock()
+	delete(r.registered, service.ID)
+	r.Unlock()
+
+	if r.node != "" {
+		_, err := r.client.Catalog().Deregister(&consulapi.CatalogDeregistration{
+			Node:      r.node,
+			ServiceID: service.ID,
+		}, nil)
+		return err
+	}
 	return r.client.Agent().ServiceDeregister(service.ID)
 }
 
+// Refresh updates the service's TTL checks, if it has any, from the Docker
+// health status of its container. Containers without a health check pass.
+// ReportsHealth reports that TTL checks follow the container's health, except
+// with catalog registrations, which have no checks.
+func (r *ConsulAdapter) ReportsHealth() bool {
+	return r.node == ""
+}
+
 func (r *ConsulAdapter) Refresh(service *bridge.Service) error {
+	if r.node != "" {
+		return nil
+	}
+	status, output := ttlStatus(service.Origin.Health())
+	for _, check := range r.buildChecks(service) {
+		if check.TTL == "" {
+			continue
+		}
+		if err := r.client.Agent().UpdateTTL(check.CheckID, output, status); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func ttlStatus(health string) (string, string) {
+	switch health {
+	case "":
+		return consulapi.HealthPassing, "container running"
+	case "healthy":
+		return consulapi.HealthPassing, "container healthy"
+	case "starting":
+		return consulapi.HealthWarning, "container health check starting"
+	default:
+		return consulapi.HealthCritical, "container " + health
+	}
+}
+
 func (r *ConsulAdapter) Services() ([]*bridge.Service, error) {
-	services, err := r.client.Agent().Services()
-	if err != nil {
-		return []*bridge.Service{}, err
+	var services map[string]*consulapi.AgentService
+	if r.node != "" {
+		node, _, err := r.client.Catalog().Node(r.node, nil)
+		if err != nil {
+			return []*bridge.Service{}, err
+		}
+		if node != nil {
+			services = node.Services
+		}
+	} else {
+		var err error
+		services, err = r.client.Agent().Services()
+		if err != nil {
+			return []*bridge.Service{}, err
+		}
 	}
-	out := make([]*bridge.Service, len(services))
-	i := 0
+	out := make([]*bridge.Service, 0, len(services))
 	for _, v := range services {
+		if v.Kind == consulapi.ServiceKindConnectProxy && v.Proxy != nil && v.Proxy.DestinationServiceID != "" {
+			// sidecars come and go with the services they proxy for
+			continue
+		}
 		s := &bridge.Service{
 			ID:   v.ID,
 			Name: v.Service,
@@ -121,8 +662,74 @@ func (r *ConsulAdapter) Services() ([]*bridge.Service, error) {
 			Tags: v.Tags,
 			IP:   v.Address,
 		}
-		out[i] = s
-		i++
+		if len(v.Meta) > 0 {
+			s.Attrs = make(map[string]string, len(v.Meta))
+			for k, v := range v.Meta {
+				s.Attrs["meta_"+k] = v
+			}
+		}
+		out = append(out, s)
 	}
 	return out, nil
 }
+
+// Watch runs blocking queries against the catalog entry of the agent's node,
+// or the configured node in catalog mode, and reports services that
+// disappear from it, e.g. because they were deregistered by hand or the agent
+// restarted and forgot them.
+func (r *ConsulAdapter) Watch(removed chan<- string, stop <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	node := r.node
+	if node == "" {
+		var err error
+		node, err = r.client.Agent().NodeName()
+		if err != nil {
+			return err
+		}
+	}
+
+	var index uint64
+	for {
+		opts := &consulapi.QueryOptions{WaitIndex: index, WaitTime: 5 * time.Minute}
+		catalog, meta, err := r.client.Catalog().Node(node, opts.WithContext(ctx))
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// reset the index if it goes backwards, e.g. after a snapshot restore
+		if meta.LastIndex < index {
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+
+		current := make(map[string]bool)
+		if catalog != nil {
+			for id := range catalog.Services {
+				current[id] = true
+			}
+		}
+		for id := range r.watched {
+			if current[id] {
+				continue
+			}
+			select {
+			case removed <- id:
+			case <-stop:
+				return nil
+			}
+		}
+		r.watched = current
+	}
+}
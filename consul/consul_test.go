@@ -0,0 +1,384 @@
+package consul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/gliderlabs/registrator/bridge"
+	"github.com/gliderlabs/registrator/bridge/adaptertest"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAdapter(t *testing.T) (*ConsulAdapter, func()) {
+	server, err := testutil.NewTestServerConfigT(t, nil)
+	if err != nil {
+		t.Skip("consul dev agent unavailable:", err)
+	}
+	adapter := new(Factory).New(&url.URL{Scheme: "consul", Host: server.HTTPAddr})
+	return adapter.(*ConsulAdapter), func() { server.Stop() }
+}
+
+func TestConformance(t *testing.T) {
+	adapter, stop := newTestAdapter(t)
+	defer stop()
+
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Services: true,
+		Tags:     true,
+	})
+}
+
+func TestTTLCheck(t *testing.T) {
+	adapter, stop := newTestAdapter(t)
+	defer stop()
+
+	service := adaptertest.NewService("web", "web-1", 80)
+	service.Attrs["check_ttl"] = "30s"
+	assert.NoError(t, adapter.Register(service))
+
+	checks, err := adapter.client.Agent().Checks()
+	assert.NoError(t, err)
+	if assert.Contains(t, checks, "service:"+service.ID) {
+		assert.Equal(t, consulapi.HealthPassing, checks["service:"+service.ID].Status)
+	}
+	assert.NoError(t, adapter.Refresh(service))
+
+	assert.NoError(t, adapter.Deregister(service))
+	checks, err = adapter.client.Agent().Checks()
+	assert.NoError(t, err)
+	assert.NotContains(t, checks, "service:"+service.ID)
+}
+
+func TestTTLStatus(t *testing.T) {
+	for health, expected := range map[string]string{
+		"":          consulapi.HealthPassing,
+		"healthy":   consulapi.HealthPassing,
+		"starting":  consulapi.HealthWarning,
+		"unhealthy": consulapi.HealthCritical,
+	} {
+		status, _ := ttlStatus(health)
+		assert.Equal(t, expected, status, health)
+	}
+}
+
+func TestServiceOptions(t *testing.T) {
+	service := adaptertest.NewService("web", "web-1", 80)
+	service.Attrs = map[string]string{
+		"meta_version":        "1.2",
+		"address_wan":         "203.0.113.10",
+		"address_lan_ipv4":    "10.0.0.5:8080",
+		"address_wan_ipv6":    "[2001:db8::1]:443",
+		"weights_passing":     "10",
+		"enable_tag_override": "true",
+	}
+
+	assert.Equal(t, map[string]string{"version": "1.2"}, serviceMeta(service))
+	assert.Equal(t, map[string]consulapi.ServiceAddress{
+		"wan":      {Address: "203.0.113.10", Port: 80},
+		"lan_ipv4": {Address: "10.0.0.5", Port: 8080},
+		"wan_ipv6": {Address: "2001:db8::1", Port: 443},
+	}, taggedAddresses(service))
+	assert.Equal(t, &consulapi.AgentWeights{Passing: 10, Warning: 1}, weights(service))
+
+	adapter, stop := newTestAdapter(t)
+	defer stop()
+	assert.NoError(t, adapter.Register(service))
+	defer adapter.Deregister(service)
+
+	registered, _, err := adapter.client.Agent().Service(service.ID, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2", registered.Meta["version"])
+	assert.Equal(t, 8080, registered.TaggedAddresses["lan_ipv4"].Port)
+	assert.Equal(t, consulapi.AgentWeights{Passing: 10, Warning: 1}, registered.Weights)
+	assert.True(t, registered.EnableTagOverride)
+}
+
+func TestNoServiceOptions(t *testing.T) {
+	service := adaptertest.NewService("web", "web-1", 80)
+	assert.Nil(t, serviceMeta(service))
+	assert.Nil(t, taggedAddresses(service))
+	assert.Nil(t, weights(service))
+}
+
+func TestBuildChecks(t *testing.T) {
+	service := adaptertest.NewService("web", "web-1", 80)
+	service.Attrs = map[string]string{
+		"check_https":             "/health",
+		"check_method":            "HEAD",
+		"check_header_x_api_key":  "secret",
+		"check_tls_skip_verify":   "true",
+		"check_deregister_after":  "90m",
+		"check_1_tcp":             "true",
+		"check_1_timeout":         "2s",
+		"check_2_ttl":             "30s",
+		"check_2_notes":           "heartbeat",
+		"check_10_grpc":           "health.v1",
+		"check_10_interval":       "5s",
+		"check_10_initial_status": "passing",
+		"check_3_script":          "nc $SERVICE_IP $SERVICE_PORT",
+		"check_4_docker":          "curl -f localhost/health",
+	}
+	adapter := new(ConsulAdapter)
+	checks := adapter.buildChecks(service)
+	if !assert.Len(t, checks, 6) {
+		return
+	}
+
+	https := checks[0]
+	assert.Equal(t, "service:"+service.ID, https.CheckID)
+	assert.Equal(t, "https://127.0.0.1:80/health", https.HTTP)
+	assert.Equal(t, "HEAD", https.Method)
+	assert.Equal(t, map[string][]string{"X-Api-Key": {"secret"}}, https.Header)
+	assert.True(t, https.TLSSkipVerify)
+	assert.Equal(t, "90m", https.DeregisterCriticalServiceAfter)
+	assert.Equal(t, DefaultInterval, https.Interval)
+
+	tcp := checks[1]
+	assert.Equal(t, "service:"+service.ID+":1", tcp.CheckID)
+	assert.Equal(t, "127.0.0.1:80", tcp.TCP)
+	assert.Equal(t, "2s", tcp.Timeout)
+
+	ttl := checks[2]
+	assert.Equal(t, "service:"+service.ID+":2", ttl.CheckID)
+	assert.Equal(t, "30s", ttl.TTL)
+	assert.Equal(t, "heartbeat", ttl.Notes)
+	assert.Empty(t, ttl.Interval)
+
+	script := checks[3]
+	assert.Equal(t, []string{"/bin/sh", "-c", "nc 127.0.0.1 80"}, script.Args)
+
+	docker := checks[4]
+	assert.Equal(t, service.Origin.ContainerID, docker.DockerContainerID)
+	assert.Equal(t, []string{"/bin/sh", "-c", "curl -f localhost/health"}, docker.Args)
+
+	grpc := checks[5]
+	assert.Equal(t, "service:"+service.ID+":10", grpc.CheckID)
+	assert.Equal(t, "127.0.0.1:80/health.v1", grpc.GRPC)
+	assert.Equal(t, "5s", grpc.Interval)
+	assert.Equal(t, consulapi.HealthPassing, grpc.Status)
+}
+
+func TestURIOptions(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Write([]byte(`"127.0.0.1:8300"`))
+	}))
+	defer server.Close()
+
+	tokenFile, err := ioutil.TempFile("", "consul-token")
+	assert.NoError(t, err)
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("first\n")
+	tokenFile.Close()
+
+	query := url.Values{
+		"datacenter": {"dc2"},
+		"namespace":  {"team"},
+		"partition":  {"web"},
+		"token-file": {tokenFile.Name()},
+	}
+	uri := &url.URL{Scheme: "consul", Host: server.Listener.Addr().String(), RawQuery: query.Encode()}
+	adapter := new(Factory).New(uri).(*ConsulAdapter)
+	defer adapter.Close()
+
+	assert.NoError(t, adapter.Ping())
+	req := <-requests
+	assert.Equal(t, "dc2", req.URL.Query().Get("dc"))
+	assert.Equal(t, "team", req.URL.Query().Get("ns"))
+	assert.Equal(t, "web", req.URL.Query().Get("partition"))
+	assert.Equal(t, "first", req.Header.Get("X-Consul-Token"))
+
+	assert.NoError(t, ioutil.WriteFile(tokenFile.Name(), []byte("second"), 0600))
+	changed, err := adapter.loadToken()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.NoError(t, adapter.Ping())
+	req = <-requests
+	assert.Equal(t, "second", req.Header.Get("X-Consul-Token"))
+
+	changed, err = adapter.loadToken()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+}
+
+func TestCatalogConformance(t *testing.T) {
+	server, err := testutil.NewTestServerConfigT(t, nil)
+	if err != nil {
+		t.Skip("consul dev agent unavailable:", err)
+	}
+	defer server.Stop()
+
+	uri := &url.URL{
+		Scheme:   "consul",
+		Host:     server.HTTPAddr,
+		RawQuery: "mode=catalog&node=agentless&node-address=10.0.0.9",
+	}
+	adapter := new(Factory).New(uri)
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Services: true,
+		Tags:     true,
+	})
+}
+
+func TestCatalogRegistration(t *testing.T) {
+	var registration consulapi.CatalogRegistration
+	var deregistration consulapi.CatalogDeregistration
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/catalog/register":
+			json.NewDecoder(r.Body).Decode(&registration)
+		case "/v1/catalog/deregister":
+			json.NewDecoder(r.Body).Decode(&deregistration)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		w.Write([]byte("true"))
+	}))
+	defer server.Close()
+
+	uri := &url.URL{
+		Scheme:   "consul",
+		Host:     server.Listener.Addr().String(),
+		RawQuery: "mode=catalog&node=agentless&node-address=10.0.0.9",
+	}
+	adapter := new(Factory).New(uri)
+	service := adaptertest.NewService("web", "web-1", 80)
+	service.Attrs["check_ttl"] = "30s"
+	assert.NoError(t, adapter.Register(service))
+	assert.Equal(t, "agentless", registration.Node)
+	assert.Equal(t, "10.0.0.9", registration.Address)
+	assert.Equal(t, service.ID, registration.Service.ID)
+	assert.Equal(t, "web", registration.Service.Service)
+	assert.Empty(t, registration.Checks)
+
+	assert.NoError(t, adapter.Refresh(service))
+	assert.NoError(t, adapter.Deregister(service))
+	assert.Equal(t, "agentless", deregistration.Node)
+	assert.Equal(t, service.ID, deregistration.ServiceID)
+}
+
+func TestConnect(t *testing.T) {
+	registrations := make(chan *consulapi.AgentServiceRegistration, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/agent/service/register":
+			registration := new(consulapi.AgentServiceRegistration)
+			json.NewDecoder(r.Body).Decode(registration)
+			registrations <- registration
+		case "/v1/agent/service/deregister/" + adaptertest.NewService("web", "web-1", 80).ID:
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	adapter := new(Factory).New(&url.URL{Scheme: "consul", Host: server.Listener.Addr().String()})
+
+	native := adaptertest.NewService("api", "api-1", 8080)
+	native.Attrs["connect_native"] = "true"
+	assert.NoError(t, adapter.Register(native))
+	registration := <-registrations
+	assert.True(t, registration.Connect.Native)
+
+	app := adaptertest.NewService("web", "web-1", 80)
+	app.Attrs["connect_upstreams"] = "db:9191, cache:6379"
+	assert.NoError(t, adapter.Register(app))
+	registration = <-registrations
+	sidecar := registration.Connect.SidecarService
+	assert.Equal(t, 0, sidecar.Port)
+	assert.Equal(t, []consulapi.Upstream{
+		{DestinationName: "db", LocalBindPort: 9191},
+		{DestinationName: "cache", LocalBindPort: 6379},
+	}, sidecar.Proxy.Upstreams)
+
+	// pairing the Envoy container registers the application again instead
+	envoy := adaptertest.NewService("envoy", "web-1-envoy", 21000)
+	envoy.Attrs["connect_sidecar_for"] = "web-1"
+	assert.NoError(t, adapter.Register(envoy))
+	registration = <-registrations
+	assert.Equal(t, app.ID, registration.ID)
+	assert.Equal(t, 21000, registration.Connect.SidecarService.Port)
+	assert.Equal(t, "127.0.0.1", registration.Connect.SidecarService.Address)
+
+	assert.NoError(t, adapter.Deregister(envoy))
+	registration = <-registrations
+	assert.Equal(t, app.ID, registration.ID)
+	assert.Equal(t, 0, registration.Connect.SidecarService.Port)
+
+	assert.NoError(t, adapter.Deregister(app))
+	assert.NoError(t, adapter.Deregister(envoy))
+	assert.Len(t, registrations, 0)
+}
+
+func TestConnectSidecars(t *testing.T) {
+	registrations := make(chan *consulapi.AgentServiceRegistration, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/agent/service/register" {
+			registration := new(consulapi.AgentServiceRegistration)
+			json.NewDecoder(r.Body).Decode(registration)
+			registrations <- registration
+		}
+	}))
+	defer server.Close()
+
+	adapter := new(Factory).New(&url.URL{Scheme: "consul", Host: server.Listener.Addr().String()})
+	web := adaptertest.NewService("web", "web-1", 80)
+	admin := adaptertest.NewService("admin", "web-1", 9000)
+	for _, service := range []*bridge.Service{web, admin} {
+		assert.NoError(t, adapter.Register(service))
+		<-registrations
+	}
+
+	// a sidecar for one service of the container
+	envoy := adaptertest.NewService("envoy", "web-1-envoy", 21000)
+	envoy.Attrs["connect_sidecar_for"] = "web-1:web"
+	assert.NoError(t, adapter.Register(envoy))
+	registration := <-registrations
+	assert.Equal(t, web.ID, registration.ID)
+	assert.Equal(t, 21000, registration.Connect.SidecarService.Port)
+	assert.Len(t, registrations, 0)
+
+	// and one for the whole container, with two ports; the first one paired
+	// is used, and the other takes over once it's gone
+	proxy := adaptertest.NewService("proxy", "web-1-proxy", 21001)
+	proxy.Attrs["connect_sidecar_for"] = "web-1"
+	proxyAdmin := adaptertest.NewService("proxy", "web-1-proxy", 19000)
+	proxyAdmin.Attrs["connect_sidecar_for"] = "web-1"
+	assert.NoError(t, adapter.Register(proxy))
+	for i := 0; i < 2; i++ {
+		registration = <-registrations
+		if registration.ID == admin.ID {
+			assert.Equal(t, 21001, registration.Connect.SidecarService.Port)
+		} else {
+			assert.Equal(t, 21000, registration.Connect.SidecarService.Port)
+		}
+	}
+	assert.NoError(t, adapter.Register(proxyAdmin))
+	<-registrations
+	<-registrations
+	assert.NoError(t, adapter.Deregister(proxy))
+	for i := 0; i < 2; i++ {
+		registration = <-registrations
+		if registration.ID == admin.ID {
+			assert.Equal(t, 19000, registration.Connect.SidecarService.Port)
+		}
+	}
+	assert.NoError(t, adapter.Deregister(proxyAdmin))
+	for i := 0; i < 2; i++ {
+		registration = <-registrations
+		if registration.ID == admin.ID {
+			assert.Nil(t, registration.Connect)
+		} else {
+			assert.Equal(t, 21000, registration.Connect.SidecarService.Port)
+		}
+	}
+	assert.Len(t, registrations, 0)
+}
@@ -1,16 +1,24 @@
 package consul
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gliderlabs/registrator/bridge"
 	consulapi "github.com/hashicorp/consul/api"
 )
 
+// MinSessionTTL is the shortest session TTL Consul accepts.
+const MinSessionTTL = 10
+
 func init() {
 	f := new(Factory)
 	bridge.Register(f, "consulkv")
@@ -28,16 +36,56 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 	} else if uri.Host != "" {
 		config.Address = uri.Host
 	}
+
+	format := uri.Query().Get("format")
+	if format == "" {
+		format = "plain"
+	}
+	if format != "plain" && format != "json" {
+		log.Fatal("consulkv: unsupported format: ", format)
+	}
+
+	keys, err := bridge.NewKeyTemplate(uri.Query().Get("layout"))
+	if err != nil {
+		log.Fatal("consulkv: ", err)
+	}
+	if format == "plain" && !keys.HasID() {
+		// the service ID couldn't be listed back for -cleanup
+		log.Fatal("consulkv: layouts without {id} require format=json")
+	}
+
 	client, err := consulapi.NewClient(config)
 	if err != nil {
 		log.Fatal("consulkv: ", uri.Scheme)
 	}
-	return &ConsulKVAdapter{client: client, path: path}
+	return &ConsulKVAdapter{
+		client:    client,
+		path:      strings.Trim(path, "/"),
+		format:    format,
+		keys:      keys,
+		refreshed: make(map[string]*refreshedService),
+	}
 }
 
+// ConsulKVAdapter stores services in Consul's key-value store. Keys of
+// services with a TTL are tied to a session, which Refresh renews, so they
+// are deleted once Registrator stops refreshing them. As the session is
+// shared, keys of a service that goes a TTL without a refresh, such as a
+// dead container's, are deleted when the session is renewed.
 type ConsulKVAdapter struct {
-	client *consulapi.Client
-	path   string
+	sync.Mutex
+	client    *consulapi.Client
+	path      string
+	format    string
+	keys      *bridge.KeyTemplate
+	session   string
+	renewed   time.Time
+	refreshed map[string]*refreshedService // by service ID
+}
+
+type refreshedService struct {
+	service *bridge.Service
+	at      time.Time
 }
 
 // Ping will try to connect to consul by attempting to retrieve the current leader.
@@ -53,31 +101,243 @@ func (r *ConsulKVAdapter) Ping() error {
 }
 
 func (r *ConsulKVAdapter) Register(service *bridge.Service) error {
-	log.Println("Register")
-	path := r.path[1:] + "/" + service.Name + "/" + service.ID
-	port := strconv.Itoa(service.Port)
-	addr := net.JoinHostPort(service.IP, port)
-	log.Printf("path: %s", path)
-	_, err := r.client.KV().Put(&consulapi.KVPair{Key: path, Value: []byte(addr)}, nil)
+	err := r.put(service)
+	if lost, ok := err.(*sessionError); ok {
+		log.Println("consulkv: replacing session:", err)
+		r.resetSession(lost.session)
+		err = r.put(service)
+	}
 	if err != nil {
 		log.Println("consulkv: failed to register service:", err)
+		return err
+	}
+	if service.TTL > 0 {
+		r.Lock()
+		r.refreshed[service.ID] = &refreshedService{service: service, at: time.Now()}
+		r.Unlock()
+	}
+	return nil
+}
+
+func (r *ConsulKVAdapter) put(service *bridge.Service) error {
+	values := make(map[string]string)
+	if r.keys.PerAttribute() {
+		values = r.keys.AttributeKeys(service)
+	} else {
+		value, err := r.value(service)
+		if err != nil {
+			return err
+		}
+		values[r.keys.Key(service)] = string(value)
+	}
+
+	var session string
+	if service.TTL > 0 {
+		var err error
+		session, err = r.sessionID(service.TTL)
+		if err != nil {
+			return err
+		}
+	}
+	var held error
+	for key, value := range values {
+		pair := &consulapi.KVPair{Key: r.path + "/" + key, Value: []byte(value)}
+		if session == "" {
+			if _, err := r.client.KV().Put(pair, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		pair.Session = session
+		acquired, _, err := r.client.KV().Acquire(pair, nil)
+		if err != nil && strings.Contains(strings.ToLower(err.Error()), "invalid session") {
+			return &sessionError{session: session, err: err}
+		}
+		if err != nil {
+			return err
+		}
+		if !acquired {
+			// held by another session, e.g. another host's; the
+			// session is still valid, so write the remaining keys
+			held = errors.New("key " + pair.Key + " is held by another session")
+		}
+	}
+	return held
+}
+
+// sessionID returns the adapter's session, creating it with the given TTL if
+// there is none. Consul deletes the session's keys when it is invalidated.
+func (r *ConsulKVAdapter) sessionID(ttl int) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.session != "" {
+		return r.session, nil
+	}
+	if ttl < MinSessionTTL {
+		ttl = MinSessionTTL
+	}
+	id, _, err := r.client.Session().Create(&consulapi.SessionEntry{
+		Name:      "registrator-" + bridge.Hostname,
+		TTL:       fmt.Sprintf("%ds", ttl),
+		Behavior:  consulapi.SessionBehaviorDelete,
+		LockDelay: time.Millisecond,
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	r.session = id
+	r.renewed = time.Now()
+	return id, nil
+}
+
+// sessionError is returned by put when Consul rejects the session as
+// invalid, e.g. because it expired between renewals.
+type sessionError struct {
+	session string
+	err     error
+}
+
+func (e *sessionError) Error() string {
+	return "session " + e.session + ": " + e.err.Error()
+}
+
+// resetSession forgets the invalid session, if it is still the adapter's, so
+// the next registration creates a new one. The session isn't destroyed: it is
+// gone already, and destroying a live one would delete every key it holds.
+func (r *ConsulKVAdapter) resetSession(session string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.session == session {
+		r.session = ""
 	}
-	return err
 }
 
 func (r *ConsulKVAdapter) Deregister(service *bridge.Service) error {
-	path := r.path[1:] + "/" + service.Name + "/" + service.ID
-	_, err := r.client.KV().Delete(path, nil)
+	r.Lock()
+	delete(r.refreshed, service.ID)
+	r.Unlock()
+	err := r.delete(service)
 	if err != nil {
 		log.Println("consulkv: failed to deregister service:", err)
 	}
 	return err
 }
 
+func (r *ConsulKVAdapter) delete(service *bridge.Service) error {
+	var err error
+	if r.keys.PerAttribute() {
+		_, err = r.client.KV().DeleteTree(r.key(service)+"/", nil)
+	} else {
+		_, err = r.client.KV().Delete(r.key(service), nil)
+	}
+	return err
+}
+
+// Refresh renews the session of services with a TTL, and writes the service
+// again in case its key went with an earlier session.
 func (r *ConsulKVAdapter) Refresh(service *bridge.Service) error {
+	if service.TTL <= 0 {
+		return nil
+	}
+	if err := r.renew(); err != nil {
+		log.Println("consulkv: failed to renew session:", err)
+	}
+	return r.Register(service)
+}
+
+// renew renews the session, at most once a second since every service is
+// refreshed in turn, and deletes the keys of services it would otherwise keep
+// past their TTL. A session that was invalidated is dropped, so the next
+// registration creates a new one.
+func (r *ConsulKVAdapter) renew() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.session == "" || time.Since(r.renewed) < time.Second {
+		return nil
+	}
+	for id, refreshed := range r.refreshed {
+		if time.Since(refreshed.at) < time.Duration(refreshed.service.TTL)*time.Second {
+			continue
+		}
+		log.Println("consulkv: no refresh for", id, "deleting it")
+		if err := r.delete(refreshed.service); err != nil {
+			log.Println("consulkv: failed to delete service:", err)
+			continue
+		}
+		delete(r.refreshed, id)
+	}
+	entry, _, err := r.client.Session().Renew(r.session, nil)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		log.Println("consulkv: session", r.session, "expired")
+		r.session = ""
+		return nil
+	}
+	r.renewed = time.Now()
 	return nil
 }
 
+// Services lists the services stored below the path whose keys fit the
+// layout. With the plain format only the fields in the key and the address
+// can be recovered, so services are only listed if the layout has their ID.
 func (r *ConsulKVAdapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+	pairs, _, err := r.client.KV().List(r.path+"/", nil)
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	if r.keys.PerAttribute() {
+		values := make(map[string]string, len(pairs))
+		for _, pair := range pairs {
+			values[strings.TrimPrefix(pair.Key, r.path+"/")] = string(pair.Value)
+		}
+		return r.keys.Collect(values), nil
+	}
+	out := make([]*bridge.Service, 0, len(pairs))
+	for _, pair := range pairs {
+		service, err := r.decodeService(pair)
+		if err != nil {
+			// not written by us
+			continue
+		}
+		out = append(out, service)
+	}
+	return out, nil
+}
+
+func (r *ConsulKVAdapter) key(service *bridge.Service) string {
+	return r.path + "/" + r.keys.Key(service)
+}
+
+func (r *ConsulKVAdapter) value(service *bridge.Service) ([]byte, error) {
+	if r.format != "json" {
+		return []byte(net.JoinHostPort(service.IP, strconv.Itoa(service.Port))), nil
+	}
+	return json.Marshal(bridge.NewServiceRecord(service))
+}
+
+func (r *ConsulKVAdapter) decodeService(pair *consulapi.KVPair) (*bridge.Service, error) {
+	service, _, ok := r.keys.Parse(strings.TrimPrefix(pair.Key, r.path+"/"))
+	if !ok {
+		return nil, errors.New("unexpected key: " + pair.Key)
+	}
+	if r.format != "json" {
+		if service.ID == "" {
+			return nil, errors.New("no service ID in key: " + pair.Key)
+		}
+		host, port, err := net.SplitHostPort(string(pair.Value))
+		if err != nil {
+			return nil, err
+		}
+		service.IP = host
+		service.Port, err = strconv.Atoi(port)
+		return service, err
+	}
+
+	var record bridge.ServiceRecord
+	if err := json.Unmarshal(pair.Value, &record); err != nil {
+		return nil, err
+	}
+	return record.Service(), nil
 }
@@ -0,0 +1,184 @@
+package consul
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/registrator/bridge"
+	"github.com/gliderlabs/registrator/bridge/adaptertest"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAdapter(t *testing.T, query string) (*ConsulKVAdapter, func()) {
+	server, err := testutil.NewTestServerConfigT(t, nil)
+	if err != nil {
+		t.Skip("consul dev agent unavailable:", err)
+	}
+	uri := &url.URL{Scheme: "consulkv", Host: server.HTTPAddr, Path: "/services", RawQuery: query}
+	return new(Factory).New(uri).(*ConsulKVAdapter), func() { server.Stop() }
+}
+
+func TestConformance(t *testing.T) {
+	adapter, stop := newTestAdapter(t, "")
+	defer stop()
+
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Services: true,
+		// sessions last at least 10s, and Consul waits up to twice the TTL
+		Expiry:        true,
+		ExpiryTimeout: 40 * time.Second,
+	})
+}
+
+func TestConformanceJSON(t *testing.T) {
+	adapter, stop := newTestAdapter(t, "format=json")
+	defer stop()
+
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Services:      true,
+		Tags:          true,
+		Expiry:        true,
+		ExpiryTimeout: 40 * time.Second,
+	})
+}
+
+func TestSessionRenewal(t *testing.T) {
+	adapter, stop := newTestAdapter(t, "")
+	defer stop()
+
+	service := adaptertest.NewService("web", "web-1", 80)
+	service.TTL = 30
+	assert.NoError(t, adapter.Register(service))
+	pair, _, err := adapter.client.KV().Get(adapter.key(service), nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, pair) {
+		assert.Equal(t, adapter.session, pair.Session)
+	}
+
+	// a lost session is replaced on the next refresh
+	_, err = adapter.client.Session().Destroy(adapter.session, nil)
+	assert.NoError(t, err)
+	adapter.renewed = time.Time{}
+	assert.NoError(t, adapter.Refresh(service))
+	pair, _, err = adapter.client.KV().Get(adapter.key(service), nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, pair)
+
+	// as is one invalidated between renewals, once acquiring a key fails
+	lost := adapter.session
+	_, err = adapter.client.Session().Destroy(lost, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, adapter.Register(service))
+	assert.NotEqual(t, lost, adapter.session)
+	pair, _, err = adapter.client.KV().Get(adapter.key(service), nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, pair) {
+		assert.Equal(t, adapter.session, pair.Session)
+	}
+	assert.NoError(t, adapter.Deregister(service))
+}
+
+func TestUnrefreshedServiceExpires(t *testing.T) {
+	adapter, stop := newTestAdapter(t, "")
+	defer stop()
+
+	web := adaptertest.NewService("web", "web-1", 80)
+	web.TTL = 30
+	dead := adaptertest.NewService("web", "web-2", 80)
+	dead.TTL = 30
+	assert.NoError(t, adapter.Register(web))
+	assert.NoError(t, adapter.Register(dead))
+
+	// the shared session is renewed for web, but dead's key goes once it is
+	// a TTL past its last refresh
+	adapter.refreshed[dead.ID].at = time.Now().Add(-time.Minute)
+	adapter.renewed = time.Time{}
+	assert.NoError(t, adapter.Refresh(web))
+	pair, _, err := adapter.client.KV().Get(adapter.key(dead), nil)
+	assert.NoError(t, err)
+	assert.Nil(t, pair)
+	pair, _, err = adapter.client.KV().Get(adapter.key(web), nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, pair)
+	assert.NoError(t, adapter.Deregister(web))
+}
+
+func TestKeyHeldByOtherSession(t *testing.T) {
+	adapter, stop := newTestAdapter(t, "")
+	defer stop()
+
+	web := adaptertest.NewService("web", "web-1", 80)
+	web.TTL = 30
+	assert.NoError(t, adapter.Register(web))
+	session := adapter.session
+
+	// another host's session holds the key of a second service
+	other, _, err := adapter.client.Session().Create(&consulapi.SessionEntry{
+		Name:     "registrator-other",
+		TTL:      "30s",
+		Behavior: consulapi.SessionBehaviorDelete,
+	}, nil)
+	assert.NoError(t, err)
+	api := adaptertest.NewService("api", "api-1", 8080)
+	api.TTL = 30
+	acquired, _, err := adapter.client.KV().Acquire(&consulapi.KVPair{
+		Key:     adapter.key(api),
+		Value:   []byte("10.0.0.1:8080"),
+		Session: other,
+	}, nil)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	assert.Error(t, adapter.Register(api))
+	assert.Equal(t, session, adapter.session)
+	pair, _, err := adapter.client.KV().Get(adapter.key(web), nil)
+	assert.NoError(t, err)
+	if assert.NotNil(t, pair) {
+		assert.Equal(t, session, pair.Session)
+	}
+	assert.NoError(t, adapter.Deregister(web))
+}
+
+func TestConformancePerAttribute(t *testing.T) {
+	adapter, stop := newTestAdapter(t, "layout={name}/{id}/{attr}")
+	defer stop()
+
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Services:      true,
+		Tags:          true,
+		Expiry:        true,
+		ExpiryTimeout: 40 * time.Second,
+	})
+}
+
+func TestLayout(t *testing.T) {
+	keys, _ := bridge.NewKeyTemplate("{attr.env}/{name}/{hostname}/{port}/{id}")
+	adapter := &ConsulKVAdapter{path: "services", format: "plain", keys: keys}
+	service := adaptertest.NewService("web", "web-1", 8080)
+	service.Attrs["env"] = "prod"
+
+	key := adapter.key(service)
+	assert.Equal(t, "services/prod/web/"+bridge.Hostname+"/8080/"+service.ID, key)
+	decoded, err := adapter.decodeService(&consulapi.KVPair{Key: key, Value: []byte("127.0.0.1:8080")})
+	assert.NoError(t, err)
+	assert.Equal(t, service.ID, decoded.ID)
+	assert.Equal(t, "web", decoded.Name)
+	assert.Equal(t, "prod", decoded.Attrs["env"])
+}
+
+func TestDecodePlain(t *testing.T) {
+	keys, _ := bridge.NewKeyTemplate("")
+	adapter := &ConsulKVAdapter{path: "services", format: "plain", keys: keys}
+	service, err := adapter.decodeService(&consulapi.KVPair{Key: "services/web/host:web-1:80", Value: []byte("10.0.0.1:32768")})
+	assert.NoError(t, err)
+	assert.Equal(t, "web", service.Name)
+	assert.Equal(t, "host:web-1:80", service.ID)
+	assert.Equal(t, "10.0.0.1", service.IP)
+	assert.Equal(t, 32768, service.Port)
+
+	_, err = adapter.decodeService(&consulapi.KVPair{Key: "services/other", Value: []byte("x")})
+	assert.Error(t, err)
+}
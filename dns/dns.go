@@ -0,0 +1,337 @@
+package dns
+
+import (
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/registrator/bridge"
+	"github.com/miekg/dns"
+)
+
+const DefaultTTL = 30
+
+func init() {
+	bridge.Register(new(Factory), "dns")
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	if len(uri.Path) < 2 {
+		log.Fatal("dns: zone required e.g.: dns://<listen address>:<port>/<zone>")
+	}
+	addr := uri.Host
+	if addr == "" {
+		addr = ":53"
+	}
+	ttl := DefaultTTL
+	if v := uri.Query().Get("ttl"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatal("dns: invalid ttl: ", v)
+		}
+		ttl = n
+	}
+
+	adapter := &DNSAdapter{
+		zone:     dns.Fqdn(strings.ToLower(uri.Path[1:])),
+		ttl:      ttl,
+		services: make(map[string]*entry),
+	}
+	if err := adapter.listen(addr); err != nil {
+		log.Fatal("dns: ", err)
+	}
+	return adapter
+}
+
+// DNSAdapter runs an authoritative DNS server for a single zone, answering
+// from the services registered with it.
+//
+// For a service named web in zone example.local it serves:
+//
+//	web.example.local            A, AAAA, TXT (tags)
+//	_web._tcp.example.local      SRV
+//	<instance>.web.example.local A, AAAA (SRV targets)
+type DNSAdapter struct {
+	sync.RWMutex
+	zone     string
+	ttl      int
+	services map[string]*entry
+	udp      *dns.Server
+	tcp      *dns.Server
+}
+
+type entry struct {
+	service *bridge.Service
+	expires time.Time
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+func (r *DNSAdapter) listen(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	// Serve TCP on the same port UDP was given, which matters when the
+	// configured port is 0.
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	r.udp = &dns.Server{PacketConn: pc, Handler: r}
+	r.tcp = &dns.Server{Listener: l, Handler: r}
+	for _, server := range []*dns.Server{r.udp, r.tcp} {
+		go func(server *dns.Server) {
+			if err := server.ActivateAndServe(); err != nil {
+				log.Println("dns: server stopped:", err)
+			}
+		}(server)
+	}
+	log.Println("dns: serving", r.zone, "on", pc.LocalAddr())
+	return nil
+}
+
+func (r *DNSAdapter) shutdown() {
+	r.udp.Shutdown()
+	r.tcp.Shutdown()
+}
+
+func (r *DNSAdapter) Ping() error {
+	return nil
+}
+
+func (r *DNSAdapter) Register(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	e := &entry{service: service}
+	if service.TTL > 0 {
+		e.expires = time.Now().Add(time.Duration(service.TTL) * time.Second)
+	}
+	r.services[service.ID] = e
+	return nil
+}
+
+func (r *DNSAdapter) Deregister(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.services, service.ID)
+	return nil
+}
+
+func (r *DNSAdapter) Refresh(service *bridge.Service) error {
+	return r.Register(service)
+}
+
+func (r *DNSAdapter) Services() ([]*bridge.Service, error) {
+	r.RLock()
+	defer r.RUnlock()
+	now := time.Now()
+	out := make([]*bridge.Service, 0, len(r.services))
+	for _, e := range r.services {
+		if !e.expired(now) {
+			out = append(out, e.service)
+		}
+	}
+	return out, nil
+}
+
+func (r *DNSAdapter) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	defer w.WriteMsg(m)
+
+	if len(req.Question) != 1 {
+		m.SetRcode(req, dns.RcodeFormatError)
+		return
+	}
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(r.zone, name) {
+		m.Authoritative = false
+		m.SetRcode(req, dns.RcodeRefused)
+		return
+	}
+
+	if name == r.zone {
+		if q.Qtype == dns.TypeSOA || q.Qtype == dns.TypeANY {
+			m.Answer = append(m.Answer, r.soa())
+		} else {
+			m.Ns = append(m.Ns, r.soa())
+		}
+		return
+	}
+
+	exists, answer, extra := r.lookup(strings.TrimSuffix(name, "."+r.zone), q)
+	if !exists {
+		m.SetRcode(req, dns.RcodeNameError)
+	}
+	m.Answer = answer
+	m.Extra = extra
+	if len(answer) == 0 {
+		m.Ns = append(m.Ns, r.soa())
+	}
+}
+
+// lookup answers a question for a name relative to the zone. It reports
+// whether the name exists at all, so missing names get NXDOMAIN rather than
+// an empty answer.
+func (r *DNSAdapter) lookup(rel string, q dns.Question) (bool, []dns.RR, []dns.RR) {
+	r.RLock()
+	defer r.RUnlock()
+
+	var answer, extra []dns.RR
+	exists := false
+
+	if strings.HasPrefix(rel, "_") {
+		parts := strings.SplitN(rel, ".", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "_") {
+			return false, nil, nil
+		}
+		name, proto := parts[0][1:], parts[1][1:]
+		for _, e := range r.instances(name) {
+			if portType(e.service) != proto {
+				continue
+			}
+			exists = true
+			if q.Qtype != dns.TypeSRV && q.Qtype != dns.TypeANY {
+				continue
+			}
+			target := instanceLabel(e.service) + "." + name + "." + r.zone
+			answer = append(answer, &dns.SRV{
+				Hdr:    r.header(q.Name, dns.TypeSRV, e.service),
+				Port:   uint16(e.service.Port),
+				Target: target,
+			})
+			if rr := r.address(target, dns.TypeANY, e.service); rr != nil {
+				extra = append(extra, rr)
+			}
+		}
+		return exists, answer, extra
+	}
+
+	instances := r.instances(rel)
+	if len(instances) == 0 {
+		// <instance>.<name>
+		parts := strings.SplitN(rel, ".", 2)
+		if len(parts) == 2 {
+			for _, e := range r.instances(parts[1]) {
+				if instanceLabel(e.service) == parts[0] {
+					if rr := r.address(q.Name, q.Qtype, e.service); rr != nil {
+						answer = append(answer, rr)
+					}
+					return true, answer, nil
+				}
+			}
+		}
+		return false, nil, nil
+	}
+
+	seenTags := make(map[string]bool)
+	for _, e := range instances {
+		if rr := r.address(q.Name, q.Qtype, e.service); rr != nil {
+			answer = append(answer, rr)
+		}
+		if (q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY) && len(e.service.Tags) > 0 {
+			key := strings.Join(e.service.Tags, "\x00")
+			if seenTags[key] {
+				continue
+			}
+			seenTags[key] = true
+			answer = append(answer, &dns.TXT{
+				Hdr: r.header(q.Name, dns.TypeTXT, e.service),
+				Txt: e.service.Tags,
+			})
+		}
+	}
+	return true, answer, nil
+}
+
+// instances returns the live registrations of a service name, ordered by ID
+// so answers are stable.
+func (r *DNSAdapter) instances(name string) []*entry {
+	now := time.Now()
+	var out []*entry
+	for _, e := range r.services {
+		if strings.ToLower(e.service.Name) == name && !e.expired(now) {
+			out = append(out, e)
+		}
+	}
+	sort.Sort(byID(out))
+	return out
+}
+
+// address returns the A or AAAA record for a service matching qtype, or nil
+// if there is none.
+func (r *DNSAdapter) address(name string, qtype uint16, service *bridge.Service) dns.RR {
+	ip := net.ParseIP(service.IP)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if qtype != dns.TypeA && qtype != dns.TypeANY {
+			return nil
+		}
+		return &dns.A{Hdr: r.header(name, dns.TypeA, service), A: ip4}
+	}
+	if qtype != dns.TypeAAAA && qtype != dns.TypeANY {
+		return nil
+	}
+	return &dns.AAAA{Hdr: r.header(name, dns.TypeAAAA, service), AAAA: ip}
+}
+
+func (r *DNSAdapter) header(name string, rrtype uint16, service *bridge.Service) dns.RR_Header {
+	ttl := r.ttl
+	if service != nil && service.TTL > 0 {
+		ttl = service.TTL
+	}
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: uint32(ttl)}
+}
+
+func (r *DNSAdapter) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     r.header(r.zone, dns.TypeSOA, nil),
+		Ns:      "ns." + r.zone,
+		Mbox:    "hostmaster." + r.zone,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  uint32(r.ttl),
+	}
+}
+
+func portType(service *bridge.Service) string {
+	if service.Origin.PortType == "udp" {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// instanceLabel derives a DNS label unique to a registration from its ID.
+func instanceLabel(service *bridge.Service) string {
+	label := strings.Trim(invalidLabelChars.ReplaceAllString(strings.ToLower(service.ID), "-"), "-")
+	if len(label) > 63 {
+		label = strings.TrimRight(label[:63], "-")
+	}
+	return label
+}
+
+type byID []*entry
+
+func (s byID) Len() int           { return len(s) }
+func (s byID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byID) Less(i, j int) bool { return s[i].service.ID < s[j].service.ID }
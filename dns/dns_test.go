@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/gliderlabs/registrator/bridge/adaptertest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func startAdapter(t *testing.T) (*DNSAdapter, string) {
+	adapter := new(Factory).New(&url.URL{Scheme: "dns", Host: "127.0.0.1:0", Path: "/containers.local"}).(*DNSAdapter)
+	return adapter, adapter.udp.PacketConn.LocalAddr().String()
+}
+
+func query(t *testing.T, net, addr, name string, qtype uint16) *dns.Msg {
+	c := &dns.Client{Net: net}
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	resp, _, err := c.Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestConformance(t *testing.T) {
+	adapter, _ := startAdapter(t)
+	defer adapter.shutdown()
+
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Services: true,
+		Tags:     true,
+		Expiry:   true,
+	})
+}
+
+func TestRecords(t *testing.T) {
+	adapter, addr := startAdapter(t)
+	defer adapter.shutdown()
+
+	web1 := adaptertest.NewService("web", "web-1", 8080)
+	web1.IP = "10.0.0.1"
+	web1.Tags = []string{"prod", "v2"}
+	web2 := adaptertest.NewService("web", "web-2", 8081)
+	web2.IP = "fd00::2"
+	web2.Tags = nil
+	web2.TTL = 15
+	assert.NoError(t, adapter.Register(web1))
+	assert.NoError(t, adapter.Register(web2))
+
+	resp := query(t, "udp", addr, "web.containers.local.", dns.TypeA)
+	assert.True(t, resp.Authoritative)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "10.0.0.1", resp.Answer[0].(*dns.A).A.String())
+		assert.Equal(t, uint32(DefaultTTL), resp.Answer[0].Header().Ttl)
+	}
+
+	resp = query(t, "tcp", addr, "WEB.containers.local.", dns.TypeAAAA)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "fd00::2", resp.Answer[0].(*dns.AAAA).AAAA.String())
+		assert.Equal(t, uint32(15), resp.Answer[0].Header().Ttl)
+	}
+
+	resp = query(t, "udp", addr, "web.containers.local.", dns.TypeTXT)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, []string{"prod", "v2"}, resp.Answer[0].(*dns.TXT).Txt)
+	}
+
+	resp = query(t, "udp", addr, "_web._tcp.containers.local.", dns.TypeSRV)
+	if assert.Len(t, resp.Answer, 2) && assert.Len(t, resp.Extra, 2) {
+		srv := resp.Answer[0].(*dns.SRV)
+		assert.Equal(t, uint16(8080), srv.Port)
+		assert.Equal(t, srv.Target, resp.Extra[0].Header().Name)
+
+		// SRV targets resolve on their own
+		target := query(t, "udp", addr, srv.Target, dns.TypeA)
+		if assert.Len(t, target.Answer, 1) {
+			assert.Equal(t, "10.0.0.1", target.Answer[0].(*dns.A).A.String())
+		}
+	}
+
+	resp = query(t, "udp", addr, "_web._udp.containers.local.", dns.TypeSRV)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	resp = query(t, "udp", addr, "db.containers.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Len(t, resp.Ns, 1)
+
+	resp = query(t, "udp", addr, "example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+
+	assert.NoError(t, adapter.Deregister(web1))
+	resp = query(t, "udp", addr, "web.containers.local.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 0)
+}
@@ -1,6 +1,8 @@
 package etcd
 
 import (
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net"
@@ -8,6 +10,7 @@ import (
 	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 
 	etcd2 "github.com/coreos/go-etcd/etcd"
 	"github.com/gliderlabs/registrator/bridge"
@@ -28,6 +31,23 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 		urls = append(urls, "http://127.0.0.1:2379")
 	}
 
+	format := uri.Query().Get("format")
+	if format == "" {
+		format = "plain"
+	}
+	if format != "plain" && format != "json" {
+		log.Fatal("etcd: unsupported format: ", format)
+	}
+
+	keys, err := bridge.NewKeyTemplate(uri.Query().Get("layout"))
+	if err != nil {
+		log.Fatal("etcd: ", err)
+	}
+	if format == "plain" && !keys.HasID() {
+		// the service ID couldn't be listed back for -cleanup
+		log.Fatal("etcd: layouts without {id} require format=json")
+	}
+
 	res, err := http.Get(urls[0] + "/version")
 	if err != nil {
 		log.Fatal("etcd: error retrieving version", err)
@@ -38,17 +58,22 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 
 	if match, _ := regexp.Match("0\\.4\\.*", body); match == true {
 		log.Println("etcd: using v0 client")
-		return &EtcdAdapter{client: etcd.NewClient(urls), path: uri.Path}
+		return &EtcdAdapter{client: etcd.NewClient(urls), path: uri.Path, format: format, keys: keys}
 	}
 
-	return &EtcdAdapter{client2: etcd2.NewClient(urls), path: uri.Path}
+	return &EtcdAdapter{client2: etcd2.NewClient(urls), path: uri.Path, format: format, keys: keys}
 }
 
 type EtcdAdapter struct {
 	client  *etcd.Client
 	client2 *etcd2.Client
 
-	path string
+	path   string
+	format string
+	keys   *bridge.KeyTemplate
+
+	// index to resume watching from after the watch broke
+	watchIndex uint64
 }
 
 func (r *EtcdAdapter) Ping() error {
@@ -85,15 +110,28 @@ func (r *EtcdAdapter) syncEtcdCluster() {
 func (r *EtcdAdapter) Register(service *bridge.Service) error {
 	r.syncEtcdCluster()
 
-	path := r.path + "/" + service.Name + "/" + service.ID
-	port := strconv.Itoa(service.Port)
-	addr := net.JoinHostPort(service.IP, port)
+	values := make(map[string]string)
+	if r.keys.PerAttribute() {
+		values = r.keys.AttributeKeys(service)
+	} else {
+		value, err := r.value(service)
+		if err != nil {
+			log.Println("etcd: failed to encode service:", err)
+			return err
+		}
+		values[r.keys.Key(service)] = value
+	}
 
 	var err error
-	if r.client != nil {
-		_, err = r.client.Set(path, addr, uint64(service.TTL))
-	} else {
-		_, err = r.client2.Set(path, addr, uint64(service.TTL))
+	for key, value := range values {
+		if r.client != nil {
+			_, err = r.client.Set(r.path+"/"+key, value, uint64(service.TTL))
+		} else {
+			_, err = r.client2.Set(r.path+"/"+key, value, uint64(service.TTL))
+		}
+		if err != nil {
+			break
+		}
 	}
 
 	if err != nil {
@@ -105,13 +143,14 @@ func (r *EtcdAdapter) Register(service *bridge.Service) error {
 func (r *EtcdAdapter) Deregister(service *bridge.Service) error {
 	r.syncEtcdCluster()
 
-	path := r.path + "/" + service.Name + "/" + service.ID
+	path := r.path + "/" + r.keys.Key(service)
+	recursive := r.keys.PerAttribute()
 
 	var err error
 	if r.client != nil {
-		_, err = r.client.Delete(path, false)
+		_, err = r.client.Delete(path, recursive)
 	} else {
-		_, err = r.client2.Delete(path, false)
+		_, err = r.client2.Delete(path, recursive)
 	}
 
 	if err != nil {
@@ -124,6 +163,221 @@ func (r *EtcdAdapter) Refresh(service *bridge.Service) error {
 	return r.Register(service)
 }
 
+// Services lists the services stored below the path whose keys fit the
+// layout. With the plain format only the fields in the key and the address
+// can be recovered, so services are only listed if the layout has their ID.
 func (r *EtcdAdapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+	r.syncEtcdCluster()
+
+	values := make(map[string]string)
+	if r.client != nil {
+		resp, err := r.client.Get(r.path, false, true)
+		if err != nil {
+			return servicesError(err)
+		}
+		nodeValues(resp.Node, r.path, values)
+	} else {
+		resp, err := r.client2.Get(r.path, false, true)
+		if err != nil {
+			return servicesError(err)
+		}
+		nodeValues2(resp.Node, r.path, values)
+	}
+
+	if r.keys.PerAttribute() {
+		return r.keys.Collect(values), nil
+	}
+	out := make([]*bridge.Service, 0, len(values))
+	for key, value := range values {
+		service, err := r.decodeService(key, value)
+		if err != nil {
+			// not written by us
+			continue
+		}
+		out = append(out, service)
+	}
+	return out, nil
+}
+
+// Watch reports services whose keys are deleted or expire. It needs the v2
+// client; with the v0 client nothing is watched. A watch that broke resumes
+// after the last change it saw, unless etcd no longer has that index. A
+// service with one key per attribute is reported once, whether its keys go
+// one by one or with its directory, until it is registered again.
+func (r *EtcdAdapter) Watch(removed chan<- string, stop <-chan struct{}) error {
+	if r.client2 == nil {
+		return nil
+	}
+
+	receiver := make(chan *etcd2.Response)
+	stopWatch := make(chan bool)
+	errs := make(chan error, 1)
+	index := r.watchIndex
+	reported := make(map[string]bool)
+	go func() {
+		_, err := r.client2.Watch(r.path, index, true, receiver, stopWatch)
+		errs <- err
+	}()
+
+	for {
+		select {
+		case resp, ok := <-receiver:
+			if !ok {
+				// closed by the client once the watch fails
+				return r.watchError(<-errs)
+			}
+			if resp == nil || resp.Node == nil {
+				continue
+			}
+			r.watchIndex = resp.Node.ModifiedIndex + 1
+			removal := false
+			switch resp.Action {
+			case "delete", "expire", "compareAndDelete":
+				removal = true
+			}
+			id := r.eventID(resp, removal)
+			if id == "" {
+				continue
+			}
+			if !removal {
+				// registered again, so its next removal is reported
+				delete(reported, id)
+				continue
+			}
+			if reported[id] {
+				continue
+			}
+			reported[id] = true
+			select {
+			case removed <- id:
+			case <-stop:
+				close(stopWatch)
+				return nil
+			}
+		case err := <-errs:
+			return r.watchError(err)
+		case <-stop:
+			close(stopWatch)
+			return nil
+		}
+	}
+}
+
+// watchError makes the next watch start from etcd's current index if the
+// index to resume from was cleared from its event history.
+func (r *EtcdAdapter) watchError(err error) error {
+	switch e := err.(type) {
+	case etcd2.EtcdError:
+		if e.ErrorCode == 401 {
+			r.watchIndex = 0
+		}
+	case *etcd2.EtcdError:
+		if e.ErrorCode == 401 {
+			r.watchIndex = 0
+		}
+	}
+	return err
+}
+
+// eventID returns the ID of the service a changed or deleted key belonged
+// to, if it can be told from the key or, for the id key of a per-attribute
+// layout, its value. For per-attribute layouts the key may also be a
+// service's directory, deleted along with its keys; then the ID can only be
+// told if the layout has it.
+func (r *EtcdAdapter) eventID(resp *etcd2.Response, removal bool) string {
+	key := strings.TrimPrefix(resp.Node.Key, r.path)
+	if resp.Node.Dir {
+		if !r.keys.PerAttribute() {
+			return ""
+		}
+		key += "/id"
+	}
+	service, field, ok := r.keys.Parse(key)
+	if !ok {
+		return ""
+	}
+	node := resp.Node
+	if removal {
+		node = resp.PrevNode
+	}
+	if service.ID == "" && field == "id" && node != nil && !node.Dir {
+		return node.Value
+	}
+	return service.ID
+}
+
+func (r *EtcdAdapter) value(service *bridge.Service) (string, error) {
+	if r.format != "json" {
+		return net.JoinHostPort(service.IP, strconv.Itoa(service.Port)), nil
+	}
+	value, err := json.Marshal(bridge.NewServiceRecord(service))
+	return string(value), err
+}
+
+func (r *EtcdAdapter) decodeService(key, value string) (*bridge.Service, error) {
+	service, _, ok := r.keys.Parse(key)
+	if !ok {
+		return nil, errors.New("unexpected key: " + key)
+	}
+	if r.format != "json" {
+		if service.ID == "" {
+			return nil, errors.New("no service ID in key: " + key)
+		}
+		host, port, err := net.SplitHostPort(value)
+		if err != nil {
+			return nil, err
+		}
+		service.IP = host
+		service.Port, err = strconv.Atoi(port)
+		return service, err
+	}
+
+	var record bridge.ServiceRecord
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		return nil, err
+	}
+	return record.Service(), nil
+}
+
+func servicesError(err error) ([]*bridge.Service, error) {
+	switch e := err.(type) {
+	case *etcd.EtcdError:
+		if e.ErrorCode == 100 {
+			// nothing registered yet
+			return []*bridge.Service{}, nil
+		}
+	case *etcd2.EtcdError:
+		if e.ErrorCode == 100 {
+			return []*bridge.Service{}, nil
+		}
+	}
+	return []*bridge.Service{}, err
+}
+
+// nodeValues collects the values of the keys below a node, by their key
+// relative to path.
+func nodeValues(node *etcd.Node, path string, values map[string]string) {
+	if node == nil {
+		return
+	}
+	if !node.Dir {
+		values[strings.TrimPrefix(node.Key, path)] = node.Value
+		return
+	}
+	for _, child := range node.Nodes {
+		nodeValues(child, path, values)
+	}
+}
+
+func nodeValues2(node *etcd2.Node, path string, values map[string]string) {
+	if node == nil {
+		return
+	}
+	if !node.Dir {
+		values[strings.TrimPrefix(node.Key, path)] = node.Value
+		return
+	}
+	for _, child := range node.Nodes {
+		nodeValues2(child, path, values)
+	}
 }
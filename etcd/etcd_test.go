@@ -0,0 +1,161 @@
+package etcd
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	etcd2 "github.com/coreos/go-etcd/etcd"
+	"github.com/gliderlabs/registrator/bridge"
+	"github.com/gliderlabs/registrator/bridge/adaptertest"
+	"github.com/gliderlabs/registrator/internal/etcdtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConformance(t *testing.T) {
+	host, stop := etcdtest.Start(t, true)
+	defer stop()
+
+	adapter := new(Factory).New(&url.URL{Scheme: "etcd", Host: host, Path: "/adaptertest"}).(*EtcdAdapter)
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Services: true,
+		Expiry:   true,
+		Lookup: func(service *bridge.Service) (bool, error) {
+			_, err := adapter.client2.Get(adapter.path+"/"+service.Name+"/"+service.ID, false, false)
+			switch e := err.(type) {
+			case nil:
+				return true, nil
+			case etcd2.EtcdError:
+				return false, ignoreKeyNotFound(e.ErrorCode, err)
+			case *etcd2.EtcdError:
+				return false, ignoreKeyNotFound(e.ErrorCode, err)
+			}
+			return false, err
+		},
+	})
+}
+
+func TestConformanceJSON(t *testing.T) {
+	host, stop := etcdtest.Start(t, true)
+	defer stop()
+
+	uri := &url.URL{Scheme: "etcd", Host: host, Path: "/adaptertest-json", RawQuery: "format=json"}
+	adaptertest.Run(t, new(Factory).New(uri), adaptertest.Options{
+		Services: true,
+		Tags:     true,
+		Expiry:   true,
+	})
+}
+
+func TestConformancePerAttribute(t *testing.T) {
+	host, stop := etcdtest.Start(t, true)
+	defer stop()
+
+	uri := &url.URL{Scheme: "etcd", Host: host, Path: "/adaptertest-attrs", RawQuery: "layout={name}/{id}/{attr}"}
+	adaptertest.Run(t, new(Factory).New(uri), adaptertest.Options{
+		Services: true,
+		Tags:     true,
+		Expiry:   true,
+	})
+}
+
+func TestLayout(t *testing.T) {
+	keys, _ := bridge.NewKeyTemplate("{attr.env}/{name}/{hostname}/{port}/{id}")
+	adapter := &EtcdAdapter{path: "/services", format: "plain", keys: keys}
+	service := adaptertest.NewService("web", "web-1", 8080)
+	service.Attrs["env"] = "prod"
+
+	key := "/services/prod/web/" + bridge.Hostname + "/8080/" + service.ID
+	decoded, err := adapter.decodeService(key[len(adapter.path):], "127.0.0.1:8080")
+	assert.NoError(t, err)
+	assert.Equal(t, service.ID, decoded.ID)
+	assert.Equal(t, service.Name, decoded.Name)
+	assert.Equal(t, "127.0.0.1", decoded.IP)
+	assert.Equal(t, 8080, decoded.Port)
+	assert.Equal(t, "prod", decoded.Attrs["env"])
+
+	_, err = adapter.decodeService("/web/"+service.ID, "127.0.0.1:8080")
+	assert.Error(t, err)
+}
+
+func TestJSONValue(t *testing.T) {
+	keys, _ := bridge.NewKeyTemplate("")
+	adapter := &EtcdAdapter{format: "json", keys: keys}
+	service := adaptertest.NewService("web", "web-1", 8080)
+	service.Attrs["env"] = "prod"
+
+	value, err := adapter.value(service)
+	assert.NoError(t, err)
+	decoded, err := adapter.decodeService(adapter.keys.Key(service), value)
+	assert.NoError(t, err)
+	assert.Equal(t, service.ID, decoded.ID)
+	assert.Equal(t, service.Name, decoded.Name)
+	assert.Equal(t, service.Port, decoded.Port)
+	assert.Equal(t, service.Tags, decoded.Tags)
+	assert.Equal(t, service.Attrs, decoded.Attrs)
+	assert.Equal(t, service.Origin.ContainerID, decoded.Origin.ContainerID)
+	assert.Equal(t, "tcp", decoded.Origin.PortType)
+
+	plain, err := (&EtcdAdapter{format: "plain"}).value(service)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:8080", plain)
+}
+
+func ignoreKeyNotFound(code int, err error) error {
+	if code == 100 {
+		return nil
+	}
+	return err
+}
+
+func TestWatchIndex(t *testing.T) {
+	adapter := &EtcdAdapter{watchIndex: 42}
+	err := errors.New("connection refused")
+	assert.Equal(t, err, adapter.watchError(err))
+	assert.Equal(t, uint64(42), adapter.watchIndex)
+
+	// the next watch starts over once etcd cleared the index
+	adapter.watchError(&etcd2.EtcdError{ErrorCode: 401})
+	assert.Equal(t, uint64(0), adapter.watchIndex)
+}
+
+func TestWatchPerAttribute(t *testing.T) {
+	host, stop := etcdtest.Start(t, true)
+	defer stop()
+
+	uri := &url.URL{Scheme: "etcd", Host: host, Path: "/services", RawQuery: "layout={name}/{id}/{attr}"}
+	adapter := new(Factory).New(uri).(*EtcdAdapter)
+	service := adaptertest.NewService("web", "web-1", 80)
+	assert.NoError(t, adapter.Register(service))
+
+	removed := make(chan string, 10)
+	done := make(chan struct{})
+	defer close(done)
+	go adapter.Watch(removed, done)
+	time.Sleep(500 * time.Millisecond)
+
+	expectRemoved := func() {
+		select {
+		case id := <-removed:
+			assert.Equal(t, service.ID, id)
+		case <-time.After(5 * time.Second):
+			t.Fatal("removal not reported")
+		}
+		select {
+		case id := <-removed:
+			t.Fatal("removal reported again:", id)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	// deleting the service's directory, as with rm -r
+	_, err := adapter.client2.Delete("/services/"+adapter.keys.Key(service), true)
+	assert.NoError(t, err)
+	expectRemoved()
+
+	// its keys expiring one by one, once it was registered again
+	service.TTL = 1
+	assert.NoError(t, adapter.Register(service))
+	expectRemoved()
+}
@@ -0,0 +1,400 @@
+package etcd3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/registrator/bridge"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const DefaultTimeout = 5 * time.Second
+
+func init() {
+	bridge.Register(new(Factory), "etcd3")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	query := uri.Query()
+
+	var tlsInfo transport.TLSInfo
+	tlsInfo.TrustedCAFile = query.Get("tls-ca")
+	tlsInfo.CertFile = query.Get("tls-cert")
+	tlsInfo.KeyFile = query.Get("tls-key")
+	scheme := "http://"
+	if tlsInfo.TrustedCAFile != "" || tlsInfo.CertFile != "" || query.Get("tls") == "true" {
+		scheme = "https://"
+	}
+
+	hosts := query["endpoint"]
+	if uri.Host != "" {
+		hosts = append(strings.Split(uri.Host, ","), hosts...)
+	}
+	if len(hosts) == 0 {
+		hosts = []string{"127.0.0.1:2379"}
+	}
+	endpoints := make([]string, len(hosts))
+	for i, host := range hosts {
+		endpoints[i] = scheme + host
+	}
+
+	config := clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: DefaultTimeout,
+	}
+	if scheme == "https://" {
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			log.Fatal("etcd3: invalid TLS configuration: ", err)
+		}
+		config.TLS = tlsConfig
+	}
+	if uri.User != nil {
+		config.Username = uri.User.Username()
+		config.Password, _ = uri.User.Password()
+	}
+
+	client, err := clientv3.New(config)
+	if err != nil {
+		log.Fatal("etcd3: ", err)
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = "plain"
+	}
+	if format != "plain" && format != "json" {
+		log.Fatal("etcd3: unsupported format: ", format)
+	}
+
+	keys, err := bridge.NewKeyTemplate(query.Get("layout"))
+	if err != nil {
+		log.Fatal("etcd3: ", err)
+	}
+	if format == "plain" && !keys.HasID() {
+		// the service ID couldn't be listed back for -cleanup
+		log.Fatal("etcd3: layouts without {id} require format=json")
+	}
+	return &Etcd3Adapter{
+		client: client,
+		path:   strings.TrimSuffix(uri.Path, "/"),
+		format: format,
+		keys:   keys,
+		leases: make(map[string]*lease),
+		owned:  make(map[string]string),
+	}
+}
+
+// Etcd3Adapter registers services through the etcd v3 API. Service TTLs are
+// implemented as leases that are kept alive for as long as the service is
+// registered, so keys vanish when Registrator stops.
+type Etcd3Adapter struct {
+	sync.Mutex
+	client *clientv3.Client
+	path   string
+	format string
+	keys   *bridge.KeyTemplate
+	leases map[string]*lease
+	owned  map[string]string // registered keys to service ID, for Watch
+}
+
+type lease struct {
+	id     clientv3.LeaseID
+	ttl    int
+	ctx    context.Context
+	cancel context.CancelFunc
+	lost   chan struct{}
+	// stops the keep-alive once the service goes a TTL without a refresh,
+	// as it does once the bridge keeps a dead container's services
+	idle *time.Timer
+}
+
+func (l *lease) alive() bool {
+	select {
+	case <-l.lost:
+		return false
+	case <-l.ctx.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// extend keeps the lease alive for another TTL, unless the keep-alive has
+// stopped already.
+func (l *lease) extend() bool {
+	if !l.alive() || !l.idle.Stop() {
+		return false
+	}
+	l.idle.Reset(time.Duration(l.ttl) * time.Second)
+	return true
+}
+
+func (r *Etcd3Adapter) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	_, err := r.client.Get(ctx, r.path+"/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	return err
+}
+
+func (r *Etcd3Adapter) Register(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	err := r.put(service)
+	if err != nil {
+		log.Println("etcd3: failed to register service:", err)
+	}
+	return err
+}
+
+func (r *Etcd3Adapter) put(service *bridge.Service) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	var opts []clientv3.OpOption
+	if service.TTL > 0 {
+		l, err := r.lease(service)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, clientv3.WithLease(l.id))
+	} else {
+		r.release(service.ID)
+	}
+
+	values := make(map[string]string)
+	if r.keys.PerAttribute() {
+		for key, value := range r.keys.AttributeKeys(service) {
+			values[r.path+"/"+key] = value
+		}
+	} else {
+		value, err := r.value(service)
+		if err != nil {
+			return err
+		}
+		values[r.key(service)] = value
+	}
+
+	// one transaction, so a service's keys are written together
+	ops := make([]clientv3.Op, 0, len(values))
+	for key, value := range values {
+		ops = append(ops, clientv3.OpPut(key, value, opts...))
+	}
+	if _, err := r.client.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return err
+	}
+	for key := range values {
+		r.owned[key] = service.ID
+	}
+	return nil
+}
+
+// lease returns a live lease for the service, granting one and starting its
+// keep-alive if needed.
+func (r *Etcd3Adapter) lease(service *bridge.Service) (*lease, error) {
+	if l, ok := r.leases[service.ID]; ok {
+		if l.ttl == service.TTL && l.extend() {
+			return l, nil
+		}
+		r.release(service.ID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	grant, err := r.client.Grant(ctx, int64(service.TTL))
+	if err != nil {
+		return nil, err
+	}
+
+	keepAliveCtx, stop := context.WithCancel(context.Background())
+	responses, err := r.client.KeepAlive(keepAliveCtx, grant.ID)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	l := &lease{id: grant.ID, ttl: service.TTL, ctx: keepAliveCtx, cancel: stop, lost: make(chan struct{})}
+	l.idle = time.AfterFunc(time.Duration(service.TTL)*time.Second, func() {
+		log.Println("etcd3: no refresh for", service.ID, "letting its lease expire")
+		stop()
+	})
+	go func(id string) {
+		for range responses {
+		}
+		close(l.lost)
+		if keepAliveCtx.Err() == nil {
+			log.Println("etcd3: lost lease for", id)
+		}
+	}(service.ID)
+	r.leases[service.ID] = l
+	return l, nil
+}
+
+// release stops keeping a service's lease alive and revokes it.
+func (r *Etcd3Adapter) release(id string) {
+	l, ok := r.leases[id]
+	if !ok {
+		return
+	}
+	delete(r.leases, id)
+	l.idle.Stop()
+	l.cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	r.client.Revoke(ctx, l.id)
+}
+
+func (r *Etcd3Adapter) Deregister(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	key := r.key(service)
+	var opts []clientv3.OpOption
+	if r.keys.PerAttribute() {
+		key += "/"
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	for owned := range r.owned {
+		if owned == key || r.keys.PerAttribute() && strings.HasPrefix(owned, key) {
+			delete(r.owned, owned)
+		}
+	}
+	_, err := r.client.Delete(ctx, key, opts...)
+	r.release(service.ID)
+	if err != nil {
+		log.Println("etcd3: failed to deregister service:", err)
+	}
+	return err
+}
+
+// Refresh re-registers a service only if its lease was lost, e.g. after a
+// long partition from the cluster; otherwise the keep-alive has it covered
+// until the next refresh is due.
+func (r *Etcd3Adapter) Refresh(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	if l, ok := r.leases[service.ID]; ok && l.ttl == service.TTL && l.extend() {
+		return nil
+	}
+	return r.put(service)
+}
+
+// Services lists the services stored below the path whose keys fit the
+// layout and have their ID.
+func (r *Etcd3Adapter) Services() ([]*bridge.Service, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	resp, err := r.client.Get(ctx, r.path+"/", clientv3.WithPrefix())
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+
+	if r.keys.PerAttribute() {
+		values := make(map[string]string, len(resp.Kvs))
+		for _, kv := range resp.Kvs {
+			values[strings.TrimPrefix(string(kv.Key), r.path+"/")] = string(kv.Value)
+		}
+		return r.keys.Collect(values), nil
+	}
+
+	out := make([]*bridge.Service, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		service, err := r.decodeService(strings.TrimPrefix(string(kv.Key), r.path+"/"), kv.Value)
+		if err != nil {
+			// not written by us
+			continue
+		}
+		out = append(out, service)
+	}
+	return out, nil
+}
+
+func (r *Etcd3Adapter) key(service *bridge.Service) string {
+	return r.path + "/" + r.keys.Key(service)
+}
+
+func (r *Etcd3Adapter) value(service *bridge.Service) (string, error) {
+	if r.format != "json" {
+		return net.JoinHostPort(service.IP, strconv.Itoa(service.Port)), nil
+	}
+	value, err := json.Marshal(bridge.NewServiceRecord(service))
+	return string(value), err
+}
+
+func (r *Etcd3Adapter) decodeService(key string, value []byte) (*bridge.Service, error) {
+	service, _, ok := r.keys.Parse(key)
+	if !ok {
+		return nil, errors.New("unexpected key: " + key)
+	}
+	if r.format != "json" {
+		if service.ID == "" {
+			return nil, errors.New("no service ID in key: " + key)
+		}
+		host, port, err := net.SplitHostPort(string(value))
+		if err != nil {
+			return nil, err
+		}
+		service.IP = host
+		service.Port, err = strconv.Atoi(port)
+		return service, err
+	}
+
+	var record bridge.ServiceRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+	return record.Service(), nil
+}
+
+// Watch reports services whose keys are deleted, including by their lease
+// expiring. A service with one key per attribute is reported once for all of
+// its keys deleted together.
+func (r *Etcd3Adapter) Watch(removed chan<- string, stop <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(context.Background()))
+	defer cancel()
+
+	events := r.client.Watch(ctx, r.path+"/", clientv3.WithPrefix())
+	for {
+		select {
+		case resp, ok := <-events:
+			if !ok {
+				return errors.New("etcd3: watch closed")
+			}
+			if err := resp.Err(); err != nil {
+				return err
+			}
+			reported := make(map[string]bool)
+			for _, ev := range resp.Events {
+				if ev.Type != clientv3.EventTypeDelete {
+					continue
+				}
+				r.Lock()
+				id, ok := r.owned[string(ev.Kv.Key)]
+				r.Unlock()
+				if !ok || reported[id] {
+					continue
+				}
+				reported[id] = true
+				select {
+				case removed <- id:
+				case <-stop:
+					return nil
+				}
+			}
+		case <-stop:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package etcd3
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/registrator/bridge"
+	"github.com/gliderlabs/registrator/bridge/adaptertest"
+	"github.com/gliderlabs/registrator/internal/etcdtest"
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func exists(adapter *Etcd3Adapter, service *bridge.Service) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	resp, err := adapter.client.Get(ctx, adapter.key(service))
+	if err != nil {
+		return false, err
+	}
+	return resp.Count > 0, nil
+}
+
+func TestConformance(t *testing.T) {
+	host, stop := etcdtest.Start(t, false)
+	defer stop()
+
+	adapter := new(Factory).New(&url.URL{Scheme: "etcd3", Host: host, Path: "/adaptertest"}).(*Etcd3Adapter)
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Services: true,
+		Expiry:   true,
+		Lookup: func(service *bridge.Service) (bool, error) {
+			return exists(adapter, service)
+		},
+	})
+}
+
+func TestConformanceJSON(t *testing.T) {
+	host, stop := etcdtest.Start(t, false)
+	defer stop()
+
+	uri := &url.URL{Scheme: "etcd3", Host: host, Path: "/adaptertest-json", RawQuery: "format=json&layout={name}/{hostname}/{port}"}
+	adapter := new(Factory).New(uri).(*Etcd3Adapter)
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Services: true,
+		Tags:     true,
+		Lookup: func(service *bridge.Service) (bool, error) {
+			return exists(adapter, service)
+		},
+	})
+}
+
+func TestConformancePerAttribute(t *testing.T) {
+	host, stop := etcdtest.Start(t, false)
+	defer stop()
+
+	uri := &url.URL{Scheme: "etcd3", Host: host, Path: "/adaptertest", RawQuery: "layout={name}/{id}/{attr}"}
+	adapter := new(Factory).New(uri).(*Etcd3Adapter)
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Services: true,
+		Tags:     true,
+	})
+}
+
+func TestWatchPerAttribute(t *testing.T) {
+	host, stop := etcdtest.Start(t, false)
+	defer stop()
+
+	uri := &url.URL{Scheme: "etcd3", Host: host, Path: "/services", RawQuery: "layout={name}/{id}/{attr}"}
+	adapter := new(Factory).New(uri).(*Etcd3Adapter)
+	service := adaptertest.NewService("web", "web-1", 80)
+	assert.NoError(t, adapter.Register(service))
+
+	removed := make(chan string, 10)
+	done := make(chan struct{})
+	defer close(done)
+	go adapter.Watch(removed, done)
+	time.Sleep(500 * time.Millisecond)
+
+	// deleting all of a service's keys reports it once
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	_, err := adapter.client.Delete(ctx, adapter.key(service)+"/", clientv3.WithPrefix())
+	assert.NoError(t, err)
+	select {
+	case id := <-removed:
+		assert.Equal(t, service.ID, id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("removal not reported")
+	}
+	select {
+	case id := <-removed:
+		t.Fatal("removal reported again:", id)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestLeaseKeepAlive(t *testing.T) {
+	host, stop := etcdtest.Start(t, false)
+	defer stop()
+
+	uri := &url.URL{Scheme: "etcd3", Host: host, Path: "/services", RawQuery: "format=json&layout={name}/{hostname}/{port}"}
+	adapter := new(Factory).New(uri).(*Etcd3Adapter)
+	service := adaptertest.NewService("web", "web-1", 8080)
+	service.TTL = 2
+	assert.Equal(t, "/services/web/"+bridge.Hostname+"/8080", adapter.key(service))
+
+	assert.NoError(t, adapter.Register(service))
+	// the keep-alive holds the key well past its TTL while it's refreshed,
+	// without rewriting it
+	for i := 0; i < 5; i++ {
+		time.Sleep(time.Second)
+		assert.NoError(t, adapter.Refresh(service))
+	}
+	found, err := exists(adapter, service)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	// without refreshes, as for a dead container's services, the keep-alive
+	// stops and the key expires
+	time.Sleep(5 * time.Second)
+	found, err = exists(adapter, service)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	// as it does once the keep-alive stops because Registrator died
+	assert.NoError(t, adapter.Refresh(service))
+	observer := new(Factory).New(uri).(*Etcd3Adapter)
+	adapter.client.Close()
+	time.Sleep(4 * time.Second)
+	found, err = exists(observer, service)
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
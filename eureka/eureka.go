@@ -0,0 +1,317 @@
+package eureka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/registrator/bridge"
+)
+
+const (
+	DefaultPath     = "/eureka"
+	DefaultTimeout  = 10 * time.Second
+	DefaultDuration = 90
+
+	// OwnerKey is the metadata key instances registered by Registrator are
+	// marked with, holding the Docker host's name.
+	OwnerKey = "registrator-host"
+	// TagsKey is the metadata key holding a service's tags, comma separated.
+	TagsKey = "registrator-tags"
+)
+
+func init() {
+	f := new(Factory)
+	bridge.Register(f, "eureka")
+	bridge.Register(f, "eurekas")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	base := &url.URL{Scheme: "http", Host: uri.Host, Path: strings.TrimSuffix(uri.Path, "/")}
+	if uri.Scheme == "eurekas" {
+		base.Scheme = "https"
+	}
+	if base.Host == "" {
+		log.Fatal("eureka: host required e.g.: eureka://<host>:<port>/eureka")
+	}
+	if base.Path == "" {
+		base.Path = DefaultPath
+	}
+
+	adapter := &EurekaAdapter{
+		client: &http.Client{Timeout: DefaultTimeout},
+		base:   base.String(),
+	}
+	if uri.User != nil {
+		adapter.username = uri.User.Username()
+		adapter.password, _ = uri.User.Password()
+	}
+	return adapter
+}
+
+// EurekaAdapter registers services as instances with a Netflix Eureka
+// server, using its REST API. Refresh sends the instance's heartbeat, so
+// Eureka evicts instances once Registrator stops.
+type EurekaAdapter struct {
+	client   *http.Client
+	base     string
+	username string
+	password string
+	warnTTL  sync.Once
+}
+
+// Instance is an instance as Eureka's JSON codec represents it.
+type Instance struct {
+	InstanceID       string            `json:"instanceId"`
+	HostName         string            `json:"hostName"`
+	App              string            `json:"app"`
+	IPAddr           string            `json:"ipAddr"`
+	VIPAddress       string            `json:"vipAddress"`
+	SecureVIPAddress string            `json:"secureVipAddress"`
+	Status           string            `json:"status"`
+	Port             Port              `json:"port"`
+	SecurePort       Port              `json:"securePort"`
+	DataCenterInfo   DataCenterInfo    `json:"dataCenterInfo"`
+	LeaseInfo        LeaseInfo         `json:"leaseInfo"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+}
+
+type Port struct {
+	Port    int    `json:"$"`
+	Enabled string `json:"@enabled"`
+}
+
+type DataCenterInfo struct {
+	Class string `json:"@class"`
+	Name  string `json:"name"`
+}
+
+type LeaseInfo struct {
+	RenewalIntervalInSecs int `json:"renewalIntervalInSecs"`
+	DurationInSecs        int `json:"durationInSecs"`
+}
+
+func newInstance(service *bridge.Service) *Instance {
+	metadata := map[string]string{OwnerKey: bridge.Hostname}
+	for k, v := range service.Attrs {
+		metadata[k] = v
+	}
+	if len(service.Tags) > 0 {
+		metadata[TagsKey] = strings.Join(service.Tags, ",")
+	}
+
+	duration := DefaultDuration
+	if service.TTL > 0 {
+		duration = service.TTL
+	}
+	renewal := duration / 3
+	if renewal < 1 {
+		renewal = 1
+	}
+
+	return &Instance{
+		InstanceID:       service.ID,
+		HostName:         service.IP,
+		App:              appName(service.Name),
+		IPAddr:           service.IP,
+		VIPAddress:       service.Name,
+		SecureVIPAddress: service.Name,
+		Status:           "UP",
+		Port:             Port{Port: service.Port, Enabled: "true"},
+		SecurePort:       Port{Port: 443, Enabled: "false"},
+		DataCenterInfo: DataCenterInfo{
+			Class: "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo",
+			Name:  "MyOwn",
+		},
+		LeaseInfo: LeaseInfo{RenewalIntervalInSecs: renewal, DurationInSecs: duration},
+		Metadata:  metadata,
+	}
+}
+
+// appName returns the Eureka app of a service. Eureka upper-cases app names,
+// so the service name is kept as the VIP address as well.
+func appName(name string) string {
+	return strings.ToUpper(name)
+}
+
+// Ping fetches the registered applications.
+func (r *EurekaAdapter) Ping() error {
+	_, err := r.applications()
+	return err
+}
+
+func (r *EurekaAdapter) Register(service *bridge.Service) error {
+	if service.TTL <= 0 {
+		// services only have a TTL with -ttl, and then -ttl-refresh
+		r.warnTTL.Do(func() {
+			log.Printf("eureka: no heartbeats without -ttl and -ttl-refresh, instances will be evicted after %ds", DefaultDuration)
+		})
+	}
+	err := r.register(service)
+	if err != nil {
+		log.Println("eureka: failed to register service:", err)
+	}
+	return err
+}
+
+func (r *EurekaAdapter) register(service *bridge.Service) error {
+	body, err := json.Marshal(map[string]*Instance{"instance": newInstance(service)})
+	if err != nil {
+		return err
+	}
+	_, err = r.do("POST", "/apps/"+url.PathEscape(appName(service.Name)), body)
+	return err
+}
+
+func (r *EurekaAdapter) Deregister(service *bridge.Service) error {
+	status, err := r.do("DELETE", r.instancePath(service), nil)
+	if status == http.StatusNotFound {
+		// already evicted
+		return nil
+	}
+	if err != nil {
+		log.Println("eureka: failed to deregister service:", err)
+	}
+	return err
+}
+
+// Refresh sends a heartbeat, registering the instance again if Eureka no
+// longer knows it, e.g. after it was evicted or the server restarted.
+func (r *EurekaAdapter) Refresh(service *bridge.Service) error {
+	status, err := r.do("PUT", r.instancePath(service), nil)
+	if status == http.StatusNotFound {
+		return r.Register(service)
+	}
+	return err
+}
+
+// Services lists the instances registered by Registrator on this host.
+func (r *EurekaAdapter) Services() ([]*bridge.Service, error) {
+	apps, err := r.applications()
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	out := make([]*bridge.Service, 0)
+	for _, app := range apps.Applications.Application {
+		for _, instance := range app.Instance {
+			if instance.Metadata[OwnerKey] != bridge.Hostname {
+				continue
+			}
+			out = append(out, instance.service())
+		}
+	}
+	return out, nil
+}
+
+func (i *Instance) service() *bridge.Service {
+	service := &bridge.Service{
+		ID:    i.InstanceID,
+		Name:  i.VIPAddress,
+		IP:    i.IPAddr,
+		Port:  i.Port.Port,
+		Attrs: make(map[string]string),
+	}
+	if service.Name == "" {
+		service.Name = strings.ToLower(i.App)
+	}
+	for k, v := range i.Metadata {
+		switch k {
+		case OwnerKey:
+		case TagsKey:
+			service.Tags = strings.Split(v, ",")
+		default:
+			service.Attrs[k] = v
+		}
+	}
+	return service
+}
+
+type applications struct {
+	Applications struct {
+		Application []struct {
+			Name     string    `json:"name"`
+			Instance instances `json:"instance"`
+		} `json:"application"`
+	} `json:"applications"`
+}
+
+// instances decodes the instances of an application, which older Eureka
+// servers encode as a single object rather than an array of one.
+type instances []*Instance
+
+func (i *instances) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var instance Instance
+		if err := json.Unmarshal(data, &instance); err != nil {
+			return err
+		}
+		*i = instances{&instance}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]*Instance)(i))
+}
+
+func (r *EurekaAdapter) applications() (*applications, error) {
+	req, err := r.request("GET", "/apps", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from %s: %s", req.URL, resp.Status)
+	}
+	apps := new(applications)
+	return apps, json.NewDecoder(resp.Body).Decode(apps)
+}
+
+func (r *EurekaAdapter) instancePath(service *bridge.Service) string {
+	return "/apps/" + url.PathEscape(appName(service.Name)) + "/" + url.PathEscape(service.ID)
+}
+
+// do sends a request whose response has no body of interest, and returns
+// its status.
+func (r *EurekaAdapter) do(method, path string, body []byte) (int, error) {
+	req, err := r.request(method, path, body)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status from %s %s: %s", method, req.URL, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (r *EurekaAdapter) request(method, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, r.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+	return req, nil
+}
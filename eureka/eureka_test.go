@@ -0,0 +1,143 @@
+package eureka
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gliderlabs/registrator/bridge"
+	"github.com/gliderlabs/registrator/bridge/adaptertest"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEureka implements the parts of Eureka's REST API the adapter uses.
+type fakeEureka struct {
+	sync.Mutex
+	apps       map[string]map[string]*Instance
+	heartbeats int
+	auth       string
+}
+
+func (f *fakeEureka) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.auth = req.Header.Get("Authorization")
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/eureka/apps"), "/")
+	switch {
+	case req.Method == "GET" && len(parts) == 1:
+		var apps applications
+		for name, members := range f.apps {
+			app := struct {
+				Name     string    `json:"name"`
+				Instance instances `json:"instance"`
+			}{Name: name}
+			for _, instance := range members {
+				app.Instance = append(app.Instance, instance)
+			}
+			apps.Applications.Application = append(apps.Applications.Application, app)
+		}
+		json.NewEncoder(w).Encode(apps)
+	case req.Method == "POST" && len(parts) == 2:
+		var body struct{ Instance *Instance }
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Instance.App != parts[1] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if f.apps[parts[1]] == nil {
+			f.apps[parts[1]] = make(map[string]*Instance)
+		}
+		f.apps[parts[1]][body.Instance.InstanceID] = body.Instance
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && f.apps[parts[1]][parts[2]] == nil:
+		w.WriteHeader(http.StatusNotFound)
+	case req.Method == "PUT" && len(parts) == 3:
+		f.heartbeats++
+	case req.Method == "DELETE" && len(parts) == 3:
+		delete(f.apps[parts[1]], parts[2])
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newFakeEureka() (*fakeEureka, *httptest.Server) {
+	eureka := &fakeEureka{apps: make(map[string]map[string]*Instance)}
+	return eureka, httptest.NewServer(eureka)
+}
+
+func newAdapter(server *httptest.Server, user *url.Userinfo) *EurekaAdapter {
+	host, _ := url.Parse(server.URL)
+	uri := &url.URL{Scheme: "eureka", Host: host.Host, User: user}
+	return new(Factory).New(uri).(*EurekaAdapter)
+}
+
+func TestConformance(t *testing.T) {
+	_, server := newFakeEureka()
+	defer server.Close()
+
+	adaptertest.Run(t, newAdapter(server, nil), adaptertest.Options{
+		Services: true,
+		Tags:     true,
+	})
+}
+
+func TestInstance(t *testing.T) {
+	eureka, server := newFakeEureka()
+	defer server.Close()
+
+	adapter := newAdapter(server, url.UserPassword("user", "s3cret"))
+	service := adaptertest.NewService("web", "web-1", 8080)
+	service.Attrs["version"] = "1.2"
+	service.TTL = 30
+	assert.NoError(t, adapter.Register(service))
+
+	instance := eureka.apps["WEB"][service.ID]
+	if assert.NotNil(t, instance) {
+		assert.Equal(t, "web", instance.VIPAddress)
+		assert.Equal(t, "127.0.0.1", instance.IPAddr)
+		assert.Equal(t, 8080, instance.Port.Port)
+		assert.Equal(t, "UP", instance.Status)
+		assert.Equal(t, 30, instance.LeaseInfo.DurationInSecs)
+		assert.Equal(t, "1.2", instance.Metadata["version"])
+		assert.Equal(t, bridge.Hostname, instance.Metadata[OwnerKey])
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("user", "s3cret")
+	assert.Equal(t, req.Header.Get("Authorization"), eureka.auth)
+
+	// heartbeats, and registers again once evicted
+	assert.NoError(t, adapter.Refresh(service))
+	assert.Equal(t, 1, eureka.heartbeats)
+	delete(eureka.apps["WEB"], service.ID)
+	assert.NoError(t, adapter.Refresh(service))
+	assert.NotNil(t, eureka.apps["WEB"][service.ID])
+
+	// instances of other hosts aren't listed
+	other := newInstance(adaptertest.NewService("web", "web-2", 8080))
+	other.InstanceID = "other"
+	other.Metadata[OwnerKey] = "other-host"
+	eureka.apps["WEB"]["other"] = other
+	services, err := adapter.Services()
+	assert.NoError(t, err)
+	if assert.Len(t, services, 1) {
+		assert.Equal(t, service.ID, services[0].ID)
+		assert.Equal(t, "1.2", services[0].Attrs["version"])
+	}
+}
+
+func TestSingleInstance(t *testing.T) {
+	var apps applications
+	data := `{"applications":{"application":[{"name":"WEB","instance":{"instanceId":"a","app":"WEB","port":{"$":80,"@enabled":"true"}}}]}}`
+	assert.NoError(t, json.Unmarshal([]byte(data), &apps))
+	if assert.Len(t, apps.Applications.Application, 1) {
+		instances := apps.Applications.Application[0].Instance
+		if assert.Len(t, instances, 1) {
+			assert.Equal(t, "web", instances[0].service().Name)
+			assert.Equal(t, 80, instances[0].service().Port)
+		}
+	}
+}
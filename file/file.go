@@ -0,0 +1,237 @@
+package file
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/registrator/bridge"
+	"gopkg.in/yaml.v2"
+)
+
+func init() {
+	bridge.Register(new(Factory), "file")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	path := uri.Host + uri.Path
+	if path == "" {
+		log.Fatal("file: path required e.g.: file:///var/lib/registrator/services.json")
+	}
+
+	format := uri.Query().Get("format")
+	if format == "" {
+		format = formatFromExt(path)
+	}
+	if format != "json" && format != "yaml" {
+		log.Fatal("file: unsupported format: ", format)
+	}
+
+	adapter := &FileAdapter{
+		path:     path,
+		format:   format,
+		command:  uri.Query().Get("cmd"),
+		services: make(map[string]*Record),
+	}
+	records, err := adapter.read()
+	if err != nil {
+		log.Println("file: unable to load existing catalog:", err)
+	}
+	for _, record := range records {
+		adapter.services[record.ID] = record
+	}
+	return adapter
+}
+
+func formatFromExt(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		return "yaml"
+	}
+	return "json"
+}
+
+// FileAdapter keeps a JSON or YAML file containing every registered service,
+// rewriting it atomically on each change.
+type FileAdapter struct {
+	sync.Mutex
+	path     string
+	format   string
+	command  string
+	services map[string]*Record
+}
+
+type Record struct {
+	ID            string            `json:"id" yaml:"id"`
+	Name          string            `json:"name" yaml:"name"`
+	IP            string            `json:"ip" yaml:"ip"`
+	Port          int               `json:"port" yaml:"port"`
+	Tags          []string          `json:"tags" yaml:"tags"`
+	Attrs         map[string]string `json:"attrs" yaml:"attrs"`
+	TTL           int               `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	ContainerID   string            `json:"container_id" yaml:"container_id"`
+	ContainerName string            `json:"container_name" yaml:"container_name"`
+	ExposedPort   string            `json:"exposed_port" yaml:"exposed_port"`
+	PortType      string            `json:"port_type" yaml:"port_type"`
+}
+
+func newRecord(service *bridge.Service) *Record {
+	return &Record{
+		ID:            service.ID,
+		Name:          service.Name,
+		IP:            service.IP,
+		Port:          service.Port,
+		Tags:          service.Tags,
+		Attrs:         service.Attrs,
+		TTL:           service.TTL,
+		ContainerID:   service.Origin.ContainerID,
+		ContainerName: service.Origin.ContainerName,
+		ExposedPort:   service.Origin.ExposedPort,
+		PortType:      service.Origin.PortType,
+	}
+}
+
+func (r *Record) service() *bridge.Service {
+	return &bridge.Service{
+		ID:    r.ID,
+		Name:  r.Name,
+		IP:    r.IP,
+		Port:  r.Port,
+		Tags:  r.Tags,
+		Attrs: r.Attrs,
+		TTL:   r.TTL,
+		Origin: bridge.ServicePort{
+			ContainerID:   r.ContainerID,
+			ContainerName: r.ContainerName,
+			ExposedPort:   r.ExposedPort,
+			PortType:      r.PortType,
+		},
+	}
+}
+
+// Ping checks that the catalog directory is writable.
+func (r *FileAdapter) Ping() error {
+	return bridge.CheckWritableDir(r.path)
+}
+
+func (r *FileAdapter) Register(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+
+	record := newRecord(service)
+	if reflect.DeepEqual(r.services[service.ID], record) {
+		return nil
+	}
+	r.services[service.ID] = record
+	err := r.flush()
+	if err != nil {
+		log.Println("file: failed to register service:", err)
+	}
+	return err
+}
+
+func (r *FileAdapter) Deregister(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.services[service.ID]; !ok {
+		return nil
+	}
+	delete(r.services, service.ID)
+	err := r.flush()
+	if err != nil {
+		log.Println("file: failed to deregister service:", err)
+	}
+	return err
+}
+
+func (r *FileAdapter) Refresh(service *bridge.Service) error {
+	return nil
+}
+
+// Services reads the catalog back from disk.
+func (r *FileAdapter) Services() ([]*bridge.Service, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	records, err := r.read()
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	out := make([]*bridge.Service, len(records))
+	for i, record := range records {
+		out[i] = record.service()
+	}
+	return out, nil
+}
+
+func (r *FileAdapter) read() ([]*Record, error) {
+	data, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	if r.format == "yaml" {
+		err = yaml.Unmarshal(data, &records)
+	} else {
+		err = json.Unmarshal(data, &records)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", r.path, err)
+	}
+	return records, nil
+}
+
+// flush writes the catalog to a temporary file and renames it over the
+// target, so readers never observe a partially written catalog, then runs
+// the configured command.
+func (r *FileAdapter) flush() error {
+	records := make([]*Record, 0, len(r.services))
+	for _, record := range r.services {
+		records = append(records, record)
+	}
+	sort.Sort(byID(records))
+
+	var data []byte
+	var err error
+	if r.format == "yaml" {
+		data, err = yaml.Marshal(records)
+	} else {
+		data, err = json.MarshalIndent(records, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	if err := bridge.WriteFileAtomic(r.path, data, 0644); err != nil {
+		return err
+	}
+
+	if r.command != "" {
+		cmd := exec.Command("/bin/sh", "-c", r.command)
+		cmd.Env = append(os.Environ(), "REGISTRATOR_FILE="+r.path)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("file: command failed: %v: %s", err, out)
+		}
+	}
+	return nil
+}
+
+type byID []*Record
+
+func (s byID) Len() int           { return len(s) }
+func (s byID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byID) Less(i, j int) bool { return s[i].ID < s[j].ID }
@@ -0,0 +1,66 @@
+package file
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gliderlabs/registrator/bridge/adaptertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "registrator-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestConformance(t *testing.T) {
+	for _, name := range []string{"services.json", "services.yml"} {
+		t.Run(name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			adapter := new(Factory).New(&url.URL{Scheme: "file", Path: filepath.Join(dir, name)})
+			adaptertest.Run(t, adapter, adaptertest.Options{
+				Services: true,
+				Tags:     true,
+			})
+		})
+	}
+}
+
+func TestCommandAndReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.json")
+	marker := filepath.Join(dir, "changed")
+
+	uri := &url.URL{Scheme: "file", Path: path, RawQuery: url.Values{
+		"cmd": {"cp \"$REGISTRATOR_FILE\" " + marker},
+	}.Encode()}
+	adapter := new(Factory).New(uri)
+
+	service := adaptertest.NewService("web", "web-1", 80)
+	service.Attrs["env"] = "prod"
+	assert.NoError(t, adapter.Register(service))
+
+	copied, err := ioutil.ReadFile(marker)
+	assert.NoError(t, err)
+	written, _ := ioutil.ReadFile(path)
+	assert.Equal(t, string(written), string(copied))
+
+	// A new adapter picks up the existing catalog.
+	reloaded := new(Factory).New(&url.URL{Scheme: "file", Path: path})
+	services, err := reloaded.Services()
+	assert.NoError(t, err)
+	if assert.Len(t, services, 1) {
+		assert.Equal(t, service.ID, services[0].ID)
+		assert.Equal(t, "prod", services[0].Attrs["env"])
+		assert.Equal(t, service.Origin.ContainerID, services[0].Origin.ContainerID)
+	}
+}
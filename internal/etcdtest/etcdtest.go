@@ -0,0 +1,65 @@
+// Package etcdtest runs embedded etcd servers for the tests of the etcd
+// based adapters.
+package etcdtest
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// Start runs an embedded etcd server on free ports and returns its client
+// address along with a function that stops it. With v2 the server also
+// serves the v2 API, which etcd 3.5 is the last release to have. The test is
+// skipped if the server can't be started.
+func Start(t *testing.T, v2 bool) (string, func()) {
+	dir, err := ioutil.TempDir("", "registrator-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &url.URL{Scheme: "http", Host: freeAddr(t)}
+	peer := &url.URL{Scheme: "http", Host: freeAddr(t)}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.EnableV2 = v2
+	cfg.LogLevel = "error"
+	cfg.ListenClientUrls = []url.URL{*client}
+	cfg.AdvertiseClientUrls = []url.URL{*client}
+	cfg.ListenPeerUrls = []url.URL{*peer}
+	cfg.AdvertisePeerUrls = []url.URL{*peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skip("embedded etcd unavailable:", err)
+	}
+	stop := func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		stop()
+		t.Fatal("embedded etcd did not become ready")
+	}
+	return client.Host, stop
+}
+
+// freeAddr returns a loopback address with a port the kernel picked, so
+// packages running their tests in parallel don't collide.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
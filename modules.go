@@ -3,7 +3,15 @@ package main
 import (
 	_ "github.com/gliderlabs/registrator/consul"
 	_ "github.com/gliderlabs/registrator/consulkv"
+	_ "github.com/gliderlabs/registrator/dns"
 	_ "github.com/gliderlabs/registrator/etcd"
+	_ "github.com/gliderlabs/registrator/etcd3"
+	_ "github.com/gliderlabs/registrator/eureka"
+	_ "github.com/gliderlabs/registrator/file"
+	_ "github.com/gliderlabs/registrator/prometheus"
+	_ "github.com/gliderlabs/registrator/redis"
 	_ "github.com/gliderlabs/registrator/skydns2"
+	_ "github.com/gliderlabs/registrator/sql"
+	_ "github.com/gliderlabs/registrator/webhook"
 	_ "github.com/gliderlabs/registrator/zookeeper"
 )
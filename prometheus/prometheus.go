@@ -0,0 +1,193 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/registrator/bridge"
+)
+
+func init() {
+	bridge.Register(new(Factory), "prometheus")
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	path := uri.Host + uri.Path
+	if path == "" {
+		log.Fatal("prometheus: path required e.g.: prometheus:///etc/prometheus/targets/registrator.json")
+	}
+
+	query := uri.Query()
+	var labels []string
+	if attrs := query.Get("labels"); attrs != "" {
+		labels = strings.Split(attrs, ",")
+	}
+	optIn := true
+	if v := query.Get("optin"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatal("prometheus: invalid optin value: ", v)
+		}
+		optIn = b
+	}
+
+	return &PrometheusAdapter{
+		path:     path,
+		labels:   labels,
+		optIn:    optIn,
+		services: make(map[string]*bridge.Service),
+	}
+}
+
+// PrometheusAdapter writes registered services to a file_sd_config target
+// file, one target group per service name and label set.
+type PrometheusAdapter struct {
+	sync.Mutex
+	path     string
+	labels   []string
+	optIn    bool
+	services map[string]*bridge.Service
+}
+
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// Ping checks that the target directory is writable.
+func (r *PrometheusAdapter) Ping() error {
+	return bridge.CheckWritableDir(r.path)
+}
+
+func (r *PrometheusAdapter) Register(service *bridge.Service) error {
+	if !r.scraped(service) {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.services[service.ID] = service
+	err := r.flush()
+	if err != nil {
+		log.Println("prometheus: failed to register service:", err)
+	}
+	return err
+}
+
+func (r *PrometheusAdapter) Deregister(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.services[service.ID]; !ok {
+		return nil
+	}
+	delete(r.services, service.ID)
+	err := r.flush()
+	if err != nil {
+		log.Println("prometheus: failed to deregister service:", err)
+	}
+	return err
+}
+
+func (r *PrometheusAdapter) Refresh(service *bridge.Service) error {
+	return nil
+}
+
+func (r *PrometheusAdapter) Services() ([]*bridge.Service, error) {
+	return []*bridge.Service{}, nil
+}
+
+// scraped reports whether a service should become a target. With opt-in
+// enabled, only services with SERVICE_METRICS set to a true value qualify.
+// Values that aren't booleans count as false.
+func (r *PrometheusAdapter) scraped(service *bridge.Service) bool {
+	v, ok := service.Attrs["metrics"]
+	if !ok {
+		return !r.optIn
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Println("prometheus: ignoring service with invalid metrics value:", service.ID, v)
+		return false
+	}
+	return b
+}
+
+func (r *PrometheusAdapter) groupLabels(service *bridge.Service) map[string]string {
+	labels := map[string]string{"service": service.Name}
+	if len(service.Tags) > 0 {
+		labels["tags"] = strings.Join(service.Tags, ",")
+	}
+	if path := service.Attrs["metrics_path"]; path != "" {
+		labels["__metrics_path__"] = path
+	}
+	if scheme := service.Attrs["metrics_scheme"]; scheme != "" {
+		labels["__scheme__"] = scheme
+	}
+	for _, attr := range r.labels {
+		if v, ok := service.Attrs[attr]; ok {
+			labels[invalidLabelChars.ReplaceAllString(attr, "_")] = v
+		}
+	}
+	return labels
+}
+
+func (r *PrometheusAdapter) targetGroups() []*TargetGroup {
+	groups := make(map[string]*TargetGroup)
+	for _, service := range r.services {
+		labels := r.groupLabels(service)
+		key := groupKey(labels)
+		group, ok := groups[key]
+		if !ok {
+			group = &TargetGroup{Labels: labels}
+			groups[key] = group
+		}
+		target := net.JoinHostPort(service.IP, strconv.Itoa(service.Port))
+		group.Targets = append(group.Targets, target)
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := make([]*TargetGroup, len(keys))
+	for i, key := range keys {
+		sort.Strings(groups[key].Targets)
+		out[i] = groups[key]
+	}
+	return out
+}
+
+func groupKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// the service name leads so groups sort by it
+	key := labels["service"]
+	for _, name := range names {
+		key += "\x00" + name + "=" + labels[name]
+	}
+	return key
+}
+
+// flush writes the target groups to a temporary file and renames it over
+// the target file, so Prometheus never reads a partially written file.
+func (r *PrometheusAdapter) flush() error {
+	data, err := json.MarshalIndent(r.targetGroups(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return bridge.WriteFileAtomic(r.path, data, 0644)
+}
@@ -0,0 +1,102 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/gliderlabs/registrator/bridge"
+	"github.com/gliderlabs/registrator/bridge/adaptertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func setup(t *testing.T, query url.Values) (*PrometheusAdapter, string, func()) {
+	dir, err := ioutil.TempDir("", "registrator-prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "targets.json")
+	uri := &url.URL{Scheme: "prometheus", Path: path, RawQuery: query.Encode()}
+	return new(Factory).New(uri).(*PrometheusAdapter), path, func() { os.RemoveAll(dir) }
+}
+
+func readGroups(path string) ([]*TargetGroup, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var groups []*TargetGroup
+	return groups, json.Unmarshal(data, &groups)
+}
+
+func TestConformance(t *testing.T) {
+	adapter, path, cleanup := setup(t, url.Values{"optin": {"false"}})
+	defer cleanup()
+
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Lookup: func(service *bridge.Service) (bool, error) {
+			groups, err := readGroups(path)
+			target := net.JoinHostPort(service.IP, strconv.Itoa(service.Port))
+			for _, group := range groups {
+				for _, t := range group.Targets {
+					if t == target && group.Labels["service"] == service.Name {
+						return true, err
+					}
+				}
+			}
+			return false, err
+		},
+	})
+}
+
+func TestTargetGroups(t *testing.T) {
+	adapter, path, cleanup := setup(t, url.Values{"labels": {"env,team.name"}})
+	defer cleanup()
+
+	web1 := adaptertest.NewService("web", "web-1", 8080)
+	web1.Attrs = map[string]string{"metrics": "true", "env": "prod", "team.name": "core"}
+	web2 := adaptertest.NewService("web", "web-2", 8081)
+	web2.Attrs = map[string]string{"metrics": "true", "env": "prod", "team.name": "core"}
+	api := adaptertest.NewService("api", "api-1", 9090)
+	api.Attrs = map[string]string{"metrics": "1", "metrics_path": "/stats"}
+	db := adaptertest.NewService("db", "db-1", 5432)
+	off := adaptertest.NewService("cache", "cache-1", 6379)
+	off.Attrs = map[string]string{"metrics": "false"}
+	invalid := adaptertest.NewService("queue", "queue-1", 5672)
+	invalid.Attrs = map[string]string{"metrics": "yes"}
+
+	for _, service := range []*bridge.Service{web1, web2, api, db, off, invalid} {
+		assert.NoError(t, adapter.Register(service))
+	}
+
+	groups, err := readGroups(path)
+	assert.NoError(t, err)
+	if assert.Len(t, groups, 2) {
+		assert.Equal(t, []string{"127.0.0.1:9090"}, groups[0].Targets)
+		assert.Equal(t, map[string]string{
+			"service":          "api",
+			"tags":             "adaptertest",
+			"__metrics_path__": "/stats",
+		}, groups[0].Labels)
+		assert.Equal(t, []string{"127.0.0.1:8080", "127.0.0.1:8081"}, groups[1].Targets)
+		assert.Equal(t, map[string]string{
+			"service":   "web",
+			"tags":      "adaptertest",
+			"env":       "prod",
+			"team_name": "core",
+		}, groups[1].Labels)
+	}
+
+	assert.NoError(t, adapter.Deregister(api))
+	groups, err = readGroups(path)
+	assert.NoError(t, err)
+	assert.Len(t, groups, 1)
+}
@@ -0,0 +1,295 @@
+package redis
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/registrator/bridge"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	DefaultPrefix  = "registrator"
+	DefaultTimeout = 5 * time.Second
+)
+
+func init() {
+	f := new(Factory)
+	bridge.Register(f, "redis")
+	bridge.Register(f, "rediss")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	query := uri.Query()
+	host := uri.Host
+	if host == "" {
+		host = "127.0.0.1:6379"
+	}
+
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(DefaultTimeout),
+		redis.DialReadTimeout(DefaultTimeout),
+		redis.DialWriteTimeout(DefaultTimeout),
+		redis.DialUseTLS(uri.Scheme == "rediss"),
+	}
+	if uri.User != nil {
+		if password, ok := uri.User.Password(); ok {
+			options = append(options, redis.DialUsername(uri.User.Username()), redis.DialPassword(password))
+		}
+	}
+	if v := query.Get("db"); v != "" {
+		db, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatal("redis: invalid db: ", v)
+		}
+		options = append(options, redis.DialDatabase(db))
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = "hash"
+	}
+	if format != "hash" && format != "json" {
+		log.Fatal("redis: unsupported format: ", format)
+	}
+
+	prefix := strings.Trim(uri.Path, "/")
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	channel := query.Get("channel")
+	if channel == "" {
+		channel = prefix + ":events"
+	}
+
+	return &RedisAdapter{
+		pool: &redis.Pool{
+			MaxIdle:     3,
+			IdleTimeout: 4 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", host, options...)
+			},
+		},
+		prefix:  prefix,
+		format:  format,
+		channel: channel,
+	}
+}
+
+// RedisAdapter stores each service under <prefix>:<service-id>, as a hash or
+// a JSON string, expiring with the service's TTL. Registrations and
+// deregistrations are published as events on a channel.
+type RedisAdapter struct {
+	pool    *redis.Pool
+	prefix  string
+	format  string
+	channel string
+}
+
+// Event is published on the channel when a service is registered or
+// deregistered.
+type Event struct {
+	Event   string                `json:"event"`
+	Host    string                `json:"host"`
+	Service *bridge.ServiceRecord `json:"service"`
+}
+
+func (r *RedisAdapter) Ping() error {
+	conn := r.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+func (r *RedisAdapter) Register(service *bridge.Service) error {
+	err := r.put(service)
+	if err == nil {
+		err = r.publish("register", service)
+	}
+	if err != nil {
+		log.Println("redis: failed to register service:", err)
+	}
+	return err
+}
+
+// put writes the service, replacing any earlier value, and sets its expiry
+// in the same transaction.
+func (r *RedisAdapter) put(service *bridge.Service) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	key := r.key(service.ID)
+	conn.Send("MULTI")
+	if r.format == "json" {
+		value, err := json.Marshal(bridge.NewServiceRecord(service))
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+		conn.Send("SET", key, value)
+	} else {
+		conn.Send("DEL", key)
+		conn.Send("HSET", redis.Args{}.Add(key).AddFlat(hashFields(service))...)
+	}
+	if service.TTL > 0 {
+		conn.Send("EXPIRE", key, service.TTL)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (r *RedisAdapter) Deregister(service *bridge.Service) error {
+	conn := r.pool.Get()
+	_, err := conn.Do("DEL", r.key(service.ID))
+	conn.Close()
+	if err == nil {
+		err = r.publish("deregister", service)
+	}
+	if err != nil {
+		log.Println("redis: failed to deregister service:", err)
+	}
+	return err
+}
+
+// Refresh extends the expiry of a service, registering it again if its key
+// is gone.
+func (r *RedisAdapter) Refresh(service *bridge.Service) error {
+	if service.TTL <= 0 {
+		return nil
+	}
+	conn := r.pool.Get()
+	extended, err := redis.Bool(conn.Do("EXPIRE", r.key(service.ID), service.TTL))
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	if !extended {
+		return r.Register(service)
+	}
+	return nil
+}
+
+// Services scans the prefix for services.
+func (r *RedisAdapter) Services() ([]*bridge.Service, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	out := make([]*bridge.Service, 0)
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", r.prefix+":*", "COUNT", 100))
+		if err != nil {
+			return []*bridge.Service{}, err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return []*bridge.Service{}, err
+		}
+		for _, key := range keys {
+			service, err := r.get(conn, key)
+			if err != nil {
+				// not written by us, or expired since the scan
+				continue
+			}
+			out = append(out, service)
+		}
+		if cursor == 0 {
+			return out, nil
+		}
+	}
+}
+
+func (r *RedisAdapter) get(conn redis.Conn, key string) (*bridge.Service, error) {
+	if r.format == "json" {
+		value, err := redis.Bytes(conn.Do("GET", key))
+		if err != nil {
+			return nil, err
+		}
+		var record bridge.ServiceRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			return nil, err
+		}
+		return record.Service(), nil
+	}
+
+	fields, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+	return decodeHash(fields)
+}
+
+func (r *RedisAdapter) publish(event string, service *bridge.Service) error {
+	payload, err := json.Marshal(&Event{Event: event, Host: bridge.Hostname, Service: bridge.NewServiceRecord(service)})
+	if err != nil {
+		return err
+	}
+	conn := r.pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("PUBLISH", r.channel, payload)
+	return err
+}
+
+func (r *RedisAdapter) key(id string) string {
+	return r.prefix + ":" + id
+}
+
+// hashFields returns the hash stored for a service. Attributes are stored as
+// attr.<name> fields.
+func hashFields(service *bridge.Service) map[string]string {
+	fields := map[string]string{
+		"id":           service.ID,
+		"name":         service.Name,
+		"ip":           service.IP,
+		"port":         strconv.Itoa(service.Port),
+		"protocol":     service.Origin.PortType,
+		"tags":         strings.Join(service.Tags, ","),
+		"ttl":          strconv.Itoa(service.TTL),
+		"container_id": service.Origin.ContainerID,
+		"exposed_port": service.Origin.ExposedPort,
+	}
+	for k, v := range service.Attrs {
+		fields["attr."+k] = v
+	}
+	return fields
+}
+
+func decodeHash(fields map[string]string) (*bridge.Service, error) {
+	if fields["id"] == "" {
+		return nil, errors.New("no service ID")
+	}
+	port, err := strconv.Atoi(fields["port"])
+	if err != nil {
+		return nil, err
+	}
+	ttl, _ := strconv.Atoi(fields["ttl"])
+	service := &bridge.Service{
+		ID:    fields["id"],
+		Name:  fields["name"],
+		IP:    fields["ip"],
+		Port:  port,
+		TTL:   ttl,
+		Attrs: make(map[string]string),
+		Origin: bridge.ServicePort{
+			PortType:    fields["protocol"],
+			ContainerID: fields["container_id"],
+			ExposedPort: fields["exposed_port"],
+		},
+	}
+	if fields["tags"] != "" {
+		service.Tags = strings.Split(fields["tags"], ",")
+	}
+	for k, v := range fields {
+		if strings.HasPrefix(k, "attr.") {
+			service.Attrs[strings.TrimPrefix(k, "attr.")] = v
+		}
+	}
+	return service, nil
+}
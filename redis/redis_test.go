@@ -0,0 +1,82 @@
+package redis
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gliderlabs/registrator/bridge/adaptertest"
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAdapter(t *testing.T, query string) (*RedisAdapter, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	uri := &url.URL{Scheme: "redis", Host: server.Addr(), Path: "/services", RawQuery: query}
+	return new(Factory).New(uri).(*RedisAdapter), server
+}
+
+func TestConformance(t *testing.T) {
+	adapter, _ := newTestAdapter(t, "")
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Services: true,
+		Tags:     true,
+	})
+}
+
+func TestConformanceJSON(t *testing.T) {
+	adapter, _ := newTestAdapter(t, "format=json")
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Services: true,
+		Tags:     true,
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	adapter, server := newTestAdapter(t, "")
+	service := adaptertest.NewService("web", "web-1", 8080)
+	service.Attrs["env"] = "prod"
+	service.TTL = 30
+
+	assert.NoError(t, adapter.Register(service))
+	assert.Equal(t, 30*time.Second, server.TTL("services:"+service.ID))
+	assert.Equal(t, "prod", server.HGet("services:"+service.ID, "attr.env"))
+
+	// refreshing extends the expiry
+	server.FastForward(20 * time.Second)
+	assert.NoError(t, adapter.Refresh(service))
+	assert.Equal(t, 30*time.Second, server.TTL("services:"+service.ID))
+
+	// and registers the service again once it expired
+	server.FastForward(31 * time.Second)
+	assert.False(t, server.Exists("services:"+service.ID))
+	assert.NoError(t, adapter.Refresh(service))
+	assert.True(t, server.Exists("services:"+service.ID))
+}
+
+func TestEvents(t *testing.T) {
+	adapter, server := newTestAdapter(t, "channel=changes")
+	conn, err := redis.Dial("tcp", server.Addr())
+	assert.NoError(t, err)
+	defer conn.Close()
+	sub := redis.PubSubConn{Conn: conn}
+	assert.NoError(t, sub.Subscribe("changes"))
+	assert.IsType(t, redis.Subscription{}, sub.Receive())
+
+	service := adaptertest.NewService("web", "web-1", 8080)
+	assert.NoError(t, adapter.Register(service))
+	assert.NoError(t, adapter.Deregister(service))
+
+	for _, expected := range []string{"register", "deregister"} {
+		msg, ok := sub.Receive().(redis.Message)
+		if !assert.True(t, ok) {
+			return
+		}
+		var event Event
+		assert.NoError(t, json.Unmarshal(msg.Data, &event))
+		assert.Equal(t, expected, event.Event)
+		assert.Equal(t, service.ID, event.Service.ID)
+	}
+}
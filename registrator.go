@@ -133,6 +133,9 @@ func main() {
 
 	quit := make(chan struct{})
 
+	// Re-register services removed from the backend behind our back
+	go b.Watch(quit)
+
 	// Start the TTL refresh timer
 	if *refreshInterval > 0 {
 		ticker := time.NewTicker(time.Duration(*refreshInterval) * time.Second)
@@ -176,5 +179,8 @@ func main() {
 	}
 
 	close(quit)
+	if err := b.Close(); err != nil {
+		log.Println("failed to close adapter:", err)
+	}
 	log.Fatal("Docker event loop closed") // todo: reconnect?
 }
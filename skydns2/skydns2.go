@@ -1,10 +1,15 @@
 package skydns2
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/coreos/go-etcd/etcd"
 	"github.com/gliderlabs/registrator/bridge"
@@ -26,12 +31,59 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 		log.Fatal("skydns2: dns domain required e.g.: skydns2://<host>/<domain>")
 	}
 
-	return &Skydns2Adapter{client: etcd.NewClient(urls), path: domainPath(uri.Path[1:])}
+	query := uri.Query()
+	keys, err := bridge.NewKeyTemplate(query.Get("layout"))
+	if err != nil {
+		log.Fatal("skydns2: ", err)
+	}
+	if keys.PerAttribute() {
+		// SkyDNS reads each service from a single record
+		log.Fatal("skydns2: layouts ending in {attr} are not supported")
+	}
+
+	hostDomain := strings.Trim(query.Get("host-domain"), ".")
+	ptr := query.Get("ptr") == "true"
+	if ptr && hostDomain == "" {
+		log.Fatal("skydns2: ptr records require a host-domain")
+	}
+
+	return &Skydns2Adapter{
+		client:     etcd.NewClient(urls),
+		path:       domainPath(uri.Path[1:]),
+		keys:       keys,
+		hostDomain: hostDomain,
+		ptr:        ptr,
+		hosts:      make(map[string]map[string]string),
+		ptrs:       make(map[string]map[string]string),
+	}
 }
 
+// Skydns2Adapter writes SkyDNS 2 records to etcd. With a host domain it also
+// writes an A record for the hostname of every container with services, and
+// optionally the matching PTR record, for as long as any of its services is
+// registered.
 type Skydns2Adapter struct {
-	client *etcd.Client
-	path   string
+	sync.Mutex
+	client     *etcd.Client
+	path       string
+	keys       *bridge.KeyTemplate
+	hostDomain string
+	ptr        bool
+	hosts      map[string]map[string]string // host record key to service IDs, to its IP
+	ptrs       map[string]map[string]string // PTR record key to service IDs, to its name
+}
+
+// Record is the value SkyDNS 2, and CoreDNS's etcd plugin, read a service
+// from.
+type Record struct {
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	Priority    int    `json:"priority,omitempty"`
+	Weight      int    `json:"weight,omitempty"`
+	Text        string `json:"text,omitempty"`
+	TTL         int    `json:"ttl,omitempty"`
+	TargetStrip int    `json:"targetstrip,omitempty"`
+	Group       string `json:"group,omitempty"`
 }
 
 func (r *Skydns2Adapter) Ping() error {
@@ -44,19 +96,138 @@ func (r *Skydns2Adapter) Ping() error {
 }
 
 func (r *Skydns2Adapter) Register(service *bridge.Service) error {
-	port := strconv.Itoa(service.Port)
-	record := `{"host":"` + service.IP + `","port":` + port + `}`
-	_, err := r.client.Set(r.servicePath(service), record, uint64(service.TTL))
+	record, err := json.Marshal(newRecord(service))
+	if err != nil {
+		log.Println("skydns2: failed to encode service:", err)
+		return err
+	}
+	_, err = r.client.Set(r.servicePath(service), string(record), uint64(service.TTL))
 	if err != nil {
 		log.Println("skydns2: failed to register service:", err)
+		return err
 	}
+	if err := r.registerHost(service); err != nil {
+		log.Println("skydns2: failed to register host:", err)
+		// a failed registration is never deregistered, so don't leave the
+		// service record behind
+		if _, err := r.client.Delete(r.servicePath(service), false); err != nil && !keyNotFound(err) {
+			log.Println("skydns2: failed to roll back service:", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// registerHost writes the host records of the service's container.
+func (r *Skydns2Adapter) registerHost(service *bridge.Service) error {
+	key, name := r.hostPath(service)
+	if key == "" {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	record, _ := json.Marshal(&Record{Host: service.IP})
+	if _, err := r.client.Set(key, string(record), uint64(service.TTL)); err != nil {
+		return err
+	}
+	if r.ptr {
+		reverse := reversePath(service.IP)
+		if reverse == "" {
+			return nil
+		}
+		if err := r.setPTR(reverse, name, service.TTL); err != nil {
+			return err
+		}
+		hold(r.ptrs, reverse, service.ID, name)
+	}
+	hold(r.hosts, key, service.ID, service.IP)
+	return nil
+}
+
+func (r *Skydns2Adapter) setPTR(reverse, name string, ttl int) error {
+	record, _ := json.Marshal(&Record{Host: name + "."})
+	_, err := r.client.Set(reverse, string(record), uint64(ttl))
 	return err
 }
 
+// deregisterHost deletes the A record of the service's container once none
+// of its services are registered, and the PTR record of its IP once no
+// service with that IP is, as containers may share the host's IP. While some
+// are, the PTR record is pointed at the name of one of them.
+func (r *Skydns2Adapter) deregisterHost(service *bridge.Service) error {
+	key, _ := r.hostPath(service)
+	if key == "" {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	if reverse := reversePath(service.IP); r.ptr && reverse != "" {
+		name := r.ptrs[reverse][service.ID]
+		next, unused := release(r.ptrs, reverse, service.ID)
+		if unused {
+			if _, err := r.client.Delete(reverse, false); err != nil && !keyNotFound(err) {
+				return err
+			}
+		} else if next != name {
+			if err := r.setPTR(reverse, next, service.TTL); err != nil {
+				return err
+			}
+		}
+	}
+	if _, unused := release(r.hosts, key, service.ID); unused {
+		if _, err := r.client.Delete(key, false); err != nil && !keyNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// hold records that a service uses the record at key, with the value the
+// service writes to it.
+func hold(refs map[string]map[string]string, key, id, value string) {
+	if refs[key] == nil {
+		refs[key] = make(map[string]string)
+	}
+	refs[key][id] = value
+}
+
+// release records that a service no longer uses the record at key, and
+// reports whether no service uses it anymore. Otherwise it returns the value
+// of the remaining service with the lowest ID.
+func release(refs map[string]map[string]string, key, id string) (string, bool) {
+	delete(refs[key], id)
+	if len(refs[key]) == 0 {
+		delete(refs, key)
+		return "", true
+	}
+	ids := make([]string, 0, len(refs[key]))
+	for id := range refs[key] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return refs[key][ids[0]], false
+}
+
+// hostPath returns the key of the A record of the service's container, and
+// the name it resolves. Both are empty without a host domain or hostname.
+func (r *Skydns2Adapter) hostPath(service *bridge.Service) (string, string) {
+	hostname := strings.Trim(service.Origin.ContainerHostname, ".")
+	if r.hostDomain == "" || hostname == "" {
+		return "", ""
+	}
+	name := hostname + "." + r.hostDomain
+	return domainPath(name), name
+}
+
 func (r *Skydns2Adapter) Deregister(service *bridge.Service) error {
 	_, err := r.client.Delete(r.servicePath(service), false)
 	if err != nil {
-		log.Println("skydns2: failed to register service:", err)
+		log.Println("skydns2: failed to deregister service:", err)
+	}
+	if err := r.deregisterHost(service); err != nil {
+		log.Println("skydns2: failed to deregister host:", err)
 	}
 	return err
 }
@@ -65,12 +236,76 @@ func (r *Skydns2Adapter) Refresh(service *bridge.Service) error {
 	return r.Register(service)
 }
 
+// Services lists the records below the domain whose keys fit the layout and
+// have a service ID.
 func (r *Skydns2Adapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+	resp, err := r.client.Get(r.path, false, true)
+	if err != nil {
+		if keyNotFound(err) {
+			// nothing registered yet
+			return []*bridge.Service{}, nil
+		}
+		return []*bridge.Service{}, err
+	}
+	return r.decodeServices(resp.Node, []*bridge.Service{}), nil
+}
+
+func (r *Skydns2Adapter) decodeServices(node *etcd.Node, out []*bridge.Service) []*bridge.Service {
+	if node == nil {
+		return out
+	}
+	if node.Dir {
+		for _, child := range node.Nodes {
+			out = r.decodeServices(child, out)
+		}
+		return out
+	}
+	if r.hostDomain != "" && strings.HasPrefix(node.Key, domainPath(r.hostDomain)+"/") {
+		// a host record
+		return out
+	}
+	service, _, ok := r.keys.Parse(strings.TrimPrefix(node.Key, r.path))
+	if !ok || service.ID == "" {
+		return out
+	}
+	var record Record
+	if err := json.Unmarshal([]byte(node.Value), &record); err != nil {
+		return out
+	}
+	service.IP, service.Port = record.Host, record.Port
+	return append(out, service)
+}
+
+// newRecord builds the record of a service. The DNS TTL comes from the
+// dns_ttl attribute, separately from the TTL of the etcd key.
+func newRecord(service *bridge.Service) *Record {
+	return &Record{
+		Host:        service.IP,
+		Port:        service.Port,
+		Priority:    intAttr(service, "priority"),
+		Weight:      intAttr(service, "weight"),
+		Text:        service.Attrs["text"],
+		TTL:         intAttr(service, "dns_ttl"),
+		TargetStrip: intAttr(service, "targetstrip"),
+		Group:       service.Attrs["group"],
+	}
+}
+
+func intAttr(service *bridge.Service, name string) int {
+	v, ok := service.Attrs[name]
+	if !ok || v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Println("skydns2: ignoring invalid "+name+":", v)
+		return 0
+	}
+	return n
 }
 
 func (r *Skydns2Adapter) servicePath(service *bridge.Service) string {
-	return r.path + "/" + service.Name + "/" + service.ID
+	return r.path + "/" + r.keys.Key(service)
 }
 
 func domainPath(domain string) string {
@@ -80,3 +315,30 @@ func domainPath(domain string) string {
 	}
 	return "/skydns/" + strings.Join(components, "/")
 }
+
+// reversePath returns the key of the PTR record of an IP address, under the
+// arpa tree, or an empty string for an invalid address.
+func reversePath(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("/skydns/arpa/in-addr/%d/%d/%d/%d", ip4[0], ip4[1], ip4[2], ip4[3])
+	}
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+	}
+	return "/skydns/arpa/ip6/" + strings.Join(nibbles, "/")
+}
+
+func keyNotFound(err error) bool {
+	switch e := err.(type) {
+	case *etcd.EtcdError:
+		return e.ErrorCode == 100
+	case etcd.EtcdError:
+		return e.ErrorCode == 100
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package skydns2
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gliderlabs/registrator/bridge/adaptertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecord(t *testing.T) {
+	service := adaptertest.NewService("web", "web-1", 8080)
+	service.IP = `10.0.0.1","port":1,"x":"`
+	service.TTL = 60
+	service.Attrs["priority"] = "10"
+	service.Attrs["weight"] = "20"
+	service.Attrs["text"] = "hello \"world\""
+	service.Attrs["dns_ttl"] = "30"
+	service.Attrs["targetstrip"] = "1"
+	service.Attrs["group"] = "g1"
+
+	value, err := json.Marshal(newRecord(service))
+	assert.NoError(t, err)
+	var record Record
+	assert.NoError(t, json.Unmarshal(value, &record))
+	assert.Equal(t, Record{
+		Host:        service.IP,
+		Port:        8080,
+		Priority:    10,
+		Weight:      20,
+		Text:        "hello \"world\"",
+		TTL:         30,
+		TargetStrip: 1,
+		Group:       "g1",
+	}, record)
+
+	plain := adaptertest.NewService("web", "web-1", 8080)
+	plain.Attrs["weight"] = "heavy"
+	value, err = json.Marshal(newRecord(plain))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"host":"127.0.0.1","port":8080}`, string(value))
+}
+
+func TestHostRecords(t *testing.T) {
+	adapter := &Skydns2Adapter{hostDomain: "hosts.cluster.local", ptr: true}
+	service := adaptertest.NewService("web", "web-1", 8080)
+	service.Origin.ContainerHostname = "web-1"
+
+	key, name := adapter.hostPath(service)
+	assert.Equal(t, "/skydns/local/cluster/hosts/web-1", key)
+	assert.Equal(t, "web-1.hosts.cluster.local", name)
+
+	service.Origin.ContainerHostname = ""
+	key, _ = adapter.hostPath(service)
+	assert.Equal(t, "", key)
+
+	assert.Equal(t, "/skydns/arpa/in-addr/10/0/0/1", reversePath("10.0.0.1"))
+	assert.Equal(t, "/skydns/arpa/ip6/2/0/0/1/0/d/b/8/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/1", reversePath("2001:db8::1"))
+	assert.Equal(t, "", reversePath("not-an-ip"))
+}
+
+func TestRecordRefs(t *testing.T) {
+	// containers sharing the host's IP share its PTR record
+	refs := make(map[string]map[string]string)
+	reverse := reversePath("10.0.0.1")
+	hold(refs, reverse, "web-1:80", "web-1.hosts.local")
+	hold(refs, reverse, "api-1:80", "api-1.hosts.local")
+	hold(refs, reverse, "api-1:80", "api-1.hosts.local")
+	hold(refs, reverse, "api-1:443", "api-1.hosts.local")
+
+	// once the container it names is gone, the record names another one
+	next, unused := release(refs, reverse, "web-1:80")
+	assert.False(t, unused)
+	assert.Equal(t, "api-1.hosts.local", next)
+	next, unused = release(refs, reverse, "api-1:80")
+	assert.False(t, unused)
+	assert.Equal(t, "api-1.hosts.local", next)
+	_, unused = release(refs, reverse, "api-1:443")
+	assert.True(t, unused)
+	assert.Empty(t, refs)
+}
@@ -0,0 +1,341 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/registrator/bridge"
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+const DefaultTable = "services"
+
+var tableName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func init() {
+	f := new(Factory)
+	bridge.Register(f, "postgres")
+	bridge.Register(f, "postgresql")
+	bridge.Register(f, "mysql")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	query := uri.Query()
+	table := query.Get("table")
+	if table == "" {
+		table = DefaultTable
+	}
+	if !tableName.MatchString(table) {
+		log.Fatal("sql: invalid table name: ", table)
+	}
+	query.Del("table")
+
+	var driver, dsn string
+	switch uri.Scheme {
+	case "postgres", "postgresql":
+		driver = "postgres"
+		u := *uri
+		u.RawQuery = query.Encode()
+		dsn = u.String()
+	case "mysql":
+		driver = "mysql"
+		dsn = mysqlDSN(uri, query)
+	case "sqlite3":
+		driver = "sqlite3"
+		dsn = uri.Host + uri.Path
+		if len(query) > 0 {
+			dsn = "file:" + dsn + "?" + query.Encode()
+		}
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		log.Fatal("sql: ", err)
+	}
+	return &SQLAdapter{db: db, dialect: driver, table: table}
+}
+
+// mysqlDSN returns the MySQL driver's DSN for a registry URI, with the
+// credentials unescaped and the query parameters passed on to the driver.
+func mysqlDSN(uri *url.URL, query url.Values) string {
+	cfg := mysql.NewConfig()
+	if uri.User != nil {
+		cfg.User = uri.User.Username()
+		cfg.Passwd, _ = uri.User.Password()
+	}
+	cfg.Net = "tcp"
+	cfg.Addr = uri.Host
+	cfg.DBName = strings.TrimPrefix(uri.Path, "/")
+	if len(query) > 0 {
+		cfg.Params = make(map[string]string, len(query))
+		for key := range query {
+			cfg.Params[key] = query.Get(key)
+		}
+	}
+	return cfg.FormatDSN()
+}
+
+// SQLAdapter keeps a row per service in a database table. Rows of services
+// with a TTL are deleted once they haven't been seen for longer than it. The
+// table is created, and its schema migrated, on the first Ping.
+type SQLAdapter struct {
+	sync.Mutex
+	db       *sql.DB
+	dialect  string
+	table    string
+	migrated bool
+	expired  time.Time
+}
+
+// migrations are applied in order, once each, with {table} replaced by the
+// table name. Only ever append to them.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS {table} (
+		id VARCHAR(255) NOT NULL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		host VARCHAR(255) NOT NULL,
+		ip VARCHAR(64) NOT NULL,
+		port INTEGER NOT NULL,
+		tags TEXT NOT NULL,
+		attrs TEXT NOT NULL,
+		ttl INTEGER NOT NULL,
+		last_seen BIGINT NOT NULL
+	)`,
+	`CREATE INDEX {table}_last_seen ON {table} (last_seen)`,
+}
+
+// migrate brings the table's schema up to date, recording the applied
+// migrations in the <table>_schema table. Hosts sharing the database take
+// turns, holding an advisory lock while they migrate.
+func (r *SQLAdapter) migrate() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.migrated {
+		return nil
+	}
+
+	ctx := context.Background()
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	schema := r.table + "_schema"
+	unlock, err := r.lockSchema(ctx, conn, schema)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+schema+" (version INTEGER NOT NULL)"); err != nil {
+		return err
+	}
+	var version int
+	if err := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+schema).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		if err := r.applyMigration(ctx, conn, schema, i); err != nil {
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+	}
+	r.migrated = true
+	return nil
+}
+
+// lockSchema takes the advisory lock on the schema table, returning the
+// function that releases it. The lock belongs to the connection. SQLite has
+// no such locks, but its database isn't shared between hosts either.
+func (r *SQLAdapter) lockSchema(ctx context.Context, conn *sql.Conn, schema string) (func(), error) {
+	switch r.dialect {
+	case "postgres":
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock(hashtext($1))", schema); err != nil {
+			return nil, err
+		}
+		return func() {
+			conn.ExecContext(ctx, "SELECT pg_advisory_unlock(hashtext($1))", schema)
+		}, nil
+	case "mysql":
+		var locked sql.NullInt64
+		if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 60)", schema).Scan(&locked); err != nil {
+			return nil, err
+		}
+		if locked.Int64 != 1 {
+			return nil, errors.New("timed out waiting for another host's migration")
+		}
+		return func() {
+			var released sql.NullInt64
+			conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", schema).Scan(&released)
+		}, nil
+	}
+	return func() {}, nil
+}
+
+// applyMigration runs a migration and records its version in one
+// transaction. MySQL commits schema changes implicitly, so there a failed
+// version insert leaves the migration applied.
+func (r *SQLAdapter) applyMigration(ctx context.Context, conn *sql.Conn, schema string, i int) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(strings.Replace(migrations[i], "{table}", r.table, -1)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(r.rebind("INSERT INTO "+schema+" (version) VALUES (?)"), i+1); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Ping checks the database connection and migrates the table.
+func (r *SQLAdapter) Ping() error {
+	if err := r.db.Ping(); err != nil {
+		return err
+	}
+	return r.migrate()
+}
+
+func (r *SQLAdapter) Register(service *bridge.Service) error {
+	err := r.upsert(service)
+	if err != nil {
+		log.Println("sql: failed to register service:", err)
+	}
+	return err
+}
+
+func (r *SQLAdapter) upsert(service *bridge.Service) error {
+	if err := r.migrate(); err != nil {
+		return err
+	}
+	tags, err := json.Marshal(service.Tags)
+	if err != nil {
+		return err
+	}
+	attrs, err := json.Marshal(service.Attrs)
+	if err != nil {
+		return err
+	}
+
+	columns := []string{"name", "host", "ip", "port", "tags", "attrs", "ttl", "last_seen"}
+	updates := make([]string, len(columns))
+	for i, c := range columns {
+		if r.dialect == "mysql" {
+			updates[i] = c + " = VALUES(" + c + ")"
+		} else {
+			updates[i] = c + " = excluded." + c
+		}
+	}
+	query := "INSERT INTO " + r.table + " (id, " + strings.Join(columns, ", ") + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	if r.dialect == "mysql" {
+		query += " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+	} else {
+		query += " ON CONFLICT (id) DO UPDATE SET " + strings.Join(updates, ", ")
+	}
+	_, err = r.db.Exec(r.rebind(query),
+		service.ID, service.Name, bridge.Hostname, service.IP, service.Port,
+		string(tags), string(attrs), service.TTL, time.Now().Unix())
+	return err
+}
+
+func (r *SQLAdapter) Deregister(service *bridge.Service) error {
+	_, err := r.db.Exec(r.rebind("DELETE FROM "+r.table+" WHERE id = ?"), service.ID)
+	if err != nil {
+		log.Println("sql: failed to deregister service:", err)
+	}
+	return err
+}
+
+// Refresh updates the service's row, and with it last_seen, then expires
+// stale rows.
+func (r *SQLAdapter) Refresh(service *bridge.Service) error {
+	if err := r.upsert(service); err != nil {
+		return err
+	}
+	if err := r.expire(false); err != nil {
+		log.Println("sql: failed to expire services:", err)
+	}
+	return nil
+}
+
+// expire deletes the rows of services with a TTL that haven't been seen
+// within it. Unless forced, it runs at most once a second, since every
+// service is refreshed in turn.
+func (r *SQLAdapter) expire(force bool) error {
+	r.Lock()
+	if !force && time.Since(r.expired) < time.Second {
+		r.Unlock()
+		return nil
+	}
+	r.expired = time.Now()
+	r.Unlock()
+
+	_, err := r.db.Exec(r.rebind("DELETE FROM "+r.table+" WHERE ttl > 0 AND last_seen + ttl < ?"), time.Now().Unix())
+	return err
+}
+
+// Services lists the services in the table, after expiring stale rows.
+func (r *SQLAdapter) Services() ([]*bridge.Service, error) {
+	if err := r.migrate(); err != nil {
+		return []*bridge.Service{}, err
+	}
+	if err := r.expire(true); err != nil {
+		return []*bridge.Service{}, err
+	}
+	rows, err := r.db.Query("SELECT id, name, ip, port, tags, attrs, ttl FROM " + r.table)
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	defer rows.Close()
+
+	out := make([]*bridge.Service, 0)
+	for rows.Next() {
+		var service bridge.Service
+		var tags, attrs string
+		if err := rows.Scan(&service.ID, &service.Name, &service.IP, &service.Port, &tags, &attrs, &service.TTL); err != nil {
+			return []*bridge.Service{}, err
+		}
+		if err := json.Unmarshal([]byte(tags), &service.Tags); err != nil {
+			return []*bridge.Service{}, errors.New("invalid tags of " + service.ID + ": " + err.Error())
+		}
+		if err := json.Unmarshal([]byte(attrs), &service.Attrs); err != nil {
+			return []*bridge.Service{}, errors.New("invalid attrs of " + service.ID + ": " + err.Error())
+		}
+		out = append(out, &service)
+	}
+	return out, rows.Err()
+}
+
+// rebind replaces the ? placeholders of a query with PostgreSQL's numbered
+// ones.
+func (r *SQLAdapter) rebind(query string) string {
+	if r.dialect != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
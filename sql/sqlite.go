@@ -0,0 +1,15 @@
+//go:build cgo
+// +build cgo
+
+package sql
+
+import (
+	"github.com/gliderlabs/registrator/bridge"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The SQLite driver needs cgo, so the sqlite3 scheme is only registered in
+// binaries built with it.
+func init() {
+	bridge.Register(new(Factory), "sqlite3")
+}
@@ -0,0 +1,283 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/gliderlabs/registrator/bridge"
+)
+
+const (
+	DefaultRetries = 3
+	DefaultTimeout = 10 * time.Second
+
+	// SignatureHeader carries the hex encoded HMAC-SHA256 of the request
+	// body when a secret is configured.
+	SignatureHeader = "X-Registrator-Signature"
+	EventHeader     = "X-Registrator-Event"
+)
+
+func init() {
+	f := new(Factory)
+	bridge.Register(f, "webhook")
+	bridge.Register(f, "webhooks")
+}
+
+type Factory struct{}
+
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	query := uri.Query()
+	endpoint := &url.URL{Scheme: "http", Host: uri.Host, Path: uri.Path}
+	if uri.Scheme == "webhooks" {
+		endpoint.Scheme = "https"
+	}
+	if endpoint.Host == "" {
+		log.Fatal("webhook: host required e.g.: webhook://<host>:<port>/<path>")
+	}
+
+	headers := make(http.Header)
+	for _, h := range query["header"] {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 {
+			// not echoed, as it may hold a credential
+			log.Fatal("webhook: header must be given as <name>:<value>")
+		}
+		headers.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+
+	retries := DefaultRetries
+	if v := query.Get("retries"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatal("webhook: invalid retries: ", v)
+		}
+		retries = n
+	}
+	timeout := DefaultTimeout
+	if v := query.Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatal("webhook: invalid timeout: ", v)
+		}
+		timeout = d
+	}
+
+	// The secret is kept out of the URI, since the bridge logs it.
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if file := query.Get("secret_file"); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatal("webhook: unable to read secret: ", err)
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+
+	var services *url.URL
+	if v := query.Get("services"); v != "" {
+		ref, err := url.Parse(v)
+		if err != nil {
+			log.Fatal("webhook: invalid services endpoint: ", v)
+		}
+		services = endpoint.ResolveReference(ref)
+	}
+
+	return &WebhookAdapter{
+		client:   &http.Client{Timeout: timeout},
+		endpoint: endpoint.String(),
+		services: services,
+		headers:  headers,
+		secret:   []byte(secret),
+		retries:  retries,
+	}
+}
+
+// WebhookAdapter POSTs a JSON event to an HTTP endpoint whenever a service
+// is registered, refreshed or deregistered.
+type WebhookAdapter struct {
+	client   *http.Client
+	endpoint string
+	services *url.URL
+	headers  http.Header
+	secret   []byte
+	retries  int
+}
+
+type Event struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Service *Service  `json:"service,omitempty"`
+}
+
+type Service struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	IP            string            `json:"ip"`
+	Port          int               `json:"port"`
+	Tags          []string          `json:"tags"`
+	Attrs         map[string]string `json:"attrs"`
+	TTL           int               `json:"ttl"`
+	ContainerID   string            `json:"container_id"`
+	ContainerName string            `json:"container_name,omitempty"`
+}
+
+func newService(service *bridge.Service) *Service {
+	return &Service{
+		ID:            service.ID,
+		Name:          service.Name,
+		IP:            service.IP,
+		Port:          service.Port,
+		Tags:          service.Tags,
+		Attrs:         service.Attrs,
+		TTL:           service.TTL,
+		ContainerID:   service.Origin.ContainerID,
+		ContainerName: service.Origin.ContainerName,
+	}
+}
+
+// Ping sends a ping event, without retries.
+func (r *WebhookAdapter) Ping() error {
+	_, err := r.post(&Event{Event: "ping", Time: time.Now().UTC(), Host: bridge.Hostname})
+	return err
+}
+
+func (r *WebhookAdapter) Register(service *bridge.Service) error {
+	err := r.send("register", service)
+	if err != nil {
+		log.Println("webhook: failed to register service:", err)
+	}
+	return err
+}
+
+func (r *WebhookAdapter) Deregister(service *bridge.Service) error {
+	err := r.send("deregister", service)
+	if err != nil {
+		log.Println("webhook: failed to deregister service:", err)
+	}
+	return err
+}
+
+func (r *WebhookAdapter) Refresh(service *bridge.Service) error {
+	return r.send("refresh", service)
+}
+
+// Services fetches the current services from the optional services
+// endpoint, which must return a JSON array in the same shape as the
+// service in event payloads.
+func (r *WebhookAdapter) Services() ([]*bridge.Service, error) {
+	if r.services == nil {
+		return []*bridge.Service{}, nil
+	}
+	req, err := http.NewRequest("GET", r.services.String(), nil)
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	r.setHeaders(req, nil)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return []*bridge.Service{}, fmt.Errorf("unexpected status from %s: %s", r.services, resp.Status)
+	}
+
+	var services []*Service
+	if err := json.NewDecoder(resp.Body).Decode(&services); err != nil {
+		return []*bridge.Service{}, err
+	}
+	out := make([]*bridge.Service, len(services))
+	for i, s := range services {
+		out[i] = &bridge.Service{
+			ID:    s.ID,
+			Name:  s.Name,
+			IP:    s.IP,
+			Port:  s.Port,
+			Tags:  s.Tags,
+			Attrs: s.Attrs,
+			TTL:   s.TTL,
+			Origin: bridge.ServicePort{
+				ContainerID:   s.ContainerID,
+				ContainerName: s.ContainerName,
+			},
+		}
+	}
+	return out, nil
+}
+
+// send posts an event, retrying with exponential backoff on connection
+// errors and server errors.
+func (r *WebhookAdapter) send(event string, service *bridge.Service) error {
+	payload := &Event{
+		Event:   event,
+		Time:    time.Now().UTC(),
+		Host:    bridge.Hostname,
+		Service: newService(service),
+	}
+	b := backoff.NewExponentialBackOff()
+	for attempt := 0; ; attempt++ {
+		retry, err := r.post(payload)
+		if err == nil || !retry || attempt >= r.retries {
+			return err
+		}
+		wait := b.NextBackOff()
+		log.Printf("webhook: %s %s failed, retrying in %s: %v", event, service.ID, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// post delivers a single event and reports whether a failure is worth
+// retrying.
+func (r *WebhookAdapter) post(payload *Event) (bool, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", r.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, payload.Event)
+	r.setHeaders(req, body)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode >= 500, fmt.Errorf("unexpected status from %s: %s", r.endpoint, resp.Status)
+	}
+	return false, nil
+}
+
+// setHeaders adds the configured headers and, if a secret is set, the body's
+// HMAC-SHA256 signature.
+func (r *WebhookAdapter) setHeaders(req *http.Request, body []byte) {
+	for name, values := range r.headers {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	if len(r.secret) > 0 {
+		mac := hmac.New(sha256.New, r.secret)
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+}
@@ -0,0 +1,125 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/gliderlabs/registrator/bridge/adaptertest"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeReceiver keeps the services announced to it and serves them back.
+type fakeReceiver struct {
+	sync.Mutex
+	services  map[string]*Service
+	events    []string
+	failures  int
+	body      []byte
+	signature string
+	header    string
+}
+
+func (f *fakeReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if req.Method == "GET" {
+		out := make([]*Service, 0, len(f.services))
+		for _, s := range f.services {
+			out = append(out, s)
+		}
+		json.NewEncoder(w).Encode(out)
+		return
+	}
+	if f.failures > 0 {
+		f.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	f.body = body
+	f.signature = req.Header.Get(SignatureHeader)
+	f.header = req.Header.Get("X-Api-Key")
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.events = append(f.events, event.Event)
+	switch event.Event {
+	case "register", "refresh":
+		f.services[event.Service.ID] = event.Service
+	case "deregister":
+		delete(f.services, event.Service.ID)
+	}
+}
+
+func newReceiver() (*fakeReceiver, *httptest.Server) {
+	receiver := &fakeReceiver{services: make(map[string]*Service)}
+	return receiver, httptest.NewServer(receiver)
+}
+
+func newAdapter(server *httptest.Server, query url.Values) *WebhookAdapter {
+	host, _ := url.Parse(server.URL)
+	uri := &url.URL{Scheme: "webhook", Host: host.Host, Path: "/events", RawQuery: query.Encode()}
+	return new(Factory).New(uri).(*WebhookAdapter)
+}
+
+func TestConformance(t *testing.T) {
+	_, server := newReceiver()
+	defer server.Close()
+
+	adapter := newAdapter(server, url.Values{"services": {"/services"}})
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Services: true,
+		Tags:     true,
+	})
+}
+
+func TestSignatureAndHeaders(t *testing.T) {
+	receiver, server := newReceiver()
+	defer server.Close()
+
+	secret, _ := ioutil.TempFile("", "webhook-secret")
+	secret.WriteString("s3cret\n")
+	secret.Close()
+	defer os.Remove(secret.Name())
+
+	adapter := newAdapter(server, url.Values{
+		"secret_file": {secret.Name()},
+		"header":      {"X-Api-Key: abc"},
+	})
+	service := adaptertest.NewService("web", "web-1", 80)
+	assert.NoError(t, adapter.Register(service))
+
+	assert.Equal(t, "abc", receiver.header)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(receiver.body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), receiver.signature)
+	assert.Equal(t, service.Origin.ContainerID, receiver.services[service.ID].ContainerID)
+}
+
+func TestRetries(t *testing.T) {
+	receiver, server := newReceiver()
+	defer server.Close()
+	receiver.failures = 2
+
+	adapter := newAdapter(server, url.Values{"retries": {"2"}})
+	service := adaptertest.NewService("web", "web-1", 80)
+	assert.NoError(t, adapter.Register(service))
+	assert.Equal(t, []string{"register"}, receiver.events)
+
+	receiver.failures = 2
+	adapter.retries = 1
+	assert.Error(t, adapter.Deregister(service))
+}
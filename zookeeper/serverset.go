@@ -0,0 +1,244 @@
+package zookeeper
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/registrator/bridge"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// ServerSet is the member JSON of Finagle's ServerSets.
+type ServerSet struct {
+	ServiceEndpoint     Endpoint            `json:"serviceEndpoint"`
+	AdditionalEndpoints map[string]Endpoint `json:"additionalEndpoints"`
+	Status              string              `json:"status"`
+	Shard               *int                `json:"shard,omitempty"`
+}
+
+type Endpoint struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// member is the ServerSet member of a container. It holds the services the
+// bridge grouped for the container's published ports, so a container with
+// several ports becomes a single member with named endpoints. Its lock
+// serializes the writes of its znode, so they don't hold up the adapter.
+type member struct {
+	sync.Mutex
+	path     string
+	services map[string]*bridge.Service
+	// set once the member's last service is deregistered
+	deleted bool
+}
+
+// sorted returns the member's services ordered by exposed port.
+func (m *member) sorted() []*bridge.Service {
+	services := make([]*bridge.Service, 0, len(m.services))
+	for _, service := range m.services {
+		services = append(services, service)
+	}
+	sort.Sort(byExposedPort(services))
+	return services
+}
+
+// primary returns the service of the member's serviceEndpoint: the one with
+// SERVICE_PRIMARY set, or else the one with the lowest exposed port.
+func (m *member) primary() *bridge.Service {
+	services := m.sorted()
+	for _, service := range services {
+		if primary, _ := strconv.ParseBool(service.Attrs["primary"]); primary {
+			return service
+		}
+	}
+	return services[0]
+}
+
+func (m *member) serverSet() *ServerSet {
+	primary := m.primary()
+	set := &ServerSet{
+		ServiceEndpoint:     Endpoint{Host: primary.IP, Port: primary.Port},
+		AdditionalEndpoints: make(map[string]Endpoint),
+		Status:              "ALIVE",
+	}
+	if shard, err := strconv.Atoi(primary.Attrs["shard"]); err == nil {
+		set.Shard = &shard
+	}
+	for _, service := range m.sorted() {
+		if service == primary {
+			continue
+		}
+		set.AdditionalEndpoints[endpointName(service)] = Endpoint{Host: service.IP, Port: service.Port}
+	}
+	return set
+}
+
+// endpointName names an additional endpoint after SERVICE_<port>_ENDPOINT,
+// defaulting to the exposed port.
+func endpointName(service *bridge.Service) string {
+	if name := service.Attrs["endpoint"]; name != "" {
+		return name
+	}
+	if service.Origin.ExposedPort != "" {
+		return service.Origin.ExposedPort
+	}
+	return service.Name
+}
+
+func containerKey(service *bridge.Service) string {
+	if service.Origin.ContainerID != "" {
+		return service.Origin.ContainerID
+	}
+	return service.ID
+}
+
+// lockMember returns the locked member of a service's container, adding it
+// if there is none.
+func (r *ZkAdapter) lockMember(service *bridge.Service) *member {
+	key := containerKey(service)
+	for {
+		r.Lock()
+		m, ok := r.members[key]
+		if !ok {
+			m = &member{services: make(map[string]*bridge.Service)}
+			r.members[key] = m
+		}
+		r.Unlock()
+
+		m.Lock()
+		if !m.deleted {
+			return m
+		}
+		// deregistered meanwhile; start a new member
+		m.Unlock()
+	}
+}
+
+func (r *ZkAdapter) registerMember(service *bridge.Service) error {
+	r.Lock()
+	r.services[service.ID] = service
+	r.Unlock()
+
+	m := r.lockMember(service)
+	if len(m.services) == 0 {
+		// write the container's ports at once, rather than moving the
+		// member as they are registered in turn
+		for _, sibling := range service.Origin.ContainerServices {
+			m.services[sibling.ID] = sibling
+		}
+	}
+	m.services[service.ID] = service
+	err := r.writeMember(m)
+	path := m.path
+	m.Unlock()
+
+	if err != nil {
+		log.Println("zookeeper: failed to register service: ", err)
+		return err
+	}
+	r.watch(path)
+	return nil
+}
+
+func (r *ZkAdapter) deregisterMember(service *bridge.Service) error {
+	r.Lock()
+	delete(r.nodes, service.ID)
+	delete(r.services, service.ID)
+	key := containerKey(service)
+	m, ok := r.members[key]
+	r.Unlock()
+	if !ok {
+		return nil
+	}
+
+	m.Lock()
+	if m.deleted {
+		m.Unlock()
+		return nil
+	}
+	delete(m.services, service.ID)
+	var err error
+	if len(m.services) == 0 {
+		m.deleted = true
+		r.Lock()
+		delete(r.members, key)
+		r.Unlock()
+		err = r.deleteNode(m.path)
+	} else {
+		err = r.writeMember(m)
+	}
+	path := m.path
+	remaining := len(m.services)
+	m.Unlock()
+
+	if err != nil {
+		log.Println("zookeeper: failed to deregister service: ", err)
+		return err
+	}
+	if remaining > 0 {
+		r.watch(path)
+	}
+	return nil
+}
+
+// writeMember creates or updates a member's sequential znode below the name
+// of its primary service, moving it if the primary service changed. The old
+// znode is only deleted once the member's services point at the new one, so
+// watching it doesn't report them removed. It must be called with the member
+// locked.
+func (r *ZkAdapter) writeMember(m *member) error {
+	body, err := json.Marshal(m.serverSet())
+	if err != nil {
+		return err
+	}
+
+	base := r.path + "/" + m.primary().Name
+	old := m.path
+	if old != "" && strings.HasPrefix(old, base+"/") {
+		_, err = r.client.Set(old, body, -1)
+		if err != zk.ErrNoNode {
+			return err
+		}
+		// the znode is gone, e.g. with its session; create it again
+		old = ""
+	}
+
+	if err := r.createPath(base); err != nil {
+		return err
+	}
+	created, err := r.client.Create(base+"/member_", body, zk.FlagEphemeral|zk.FlagSequence, r.acl)
+	if err != nil {
+		return err
+	}
+	m.path = created
+	r.Lock()
+	for id := range m.services {
+		r.nodes[id] = created
+	}
+	r.Unlock()
+
+	if old != "" {
+		if err := r.deleteNode(old); err != nil {
+			log.Println("zookeeper: failed to delete moved member:", err)
+		}
+	}
+	return nil
+}
+
+type byExposedPort []*bridge.Service
+
+func (s byExposedPort) Len() int      { return len(s) }
+func (s byExposedPort) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byExposedPort) Less(i, j int) bool {
+	pi, _ := strconv.Atoi(s[i].Origin.ExposedPort)
+	pj, _ := strconv.Atoi(s[j].Origin.ExposedPort)
+	if pi != pj {
+		return pi < pj
+	}
+	return s[i].ID < s[j].ID
+}
@@ -1,10 +1,15 @@
 package zookeeper
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"log"
 	"net/url"
+	"path"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gliderlabs/registrator/bridge"
@@ -18,23 +23,81 @@ func init() {
 type Factory struct{}
 
 func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
-	c, _, err := zk.Connect([]string{uri.Host}, (time.Second * 10))
+	c, events, err := zk.Connect(strings.Split(uri.Host, ","), (time.Second * 10))
 	if err != nil {
-		panic(err)
+		log.Fatal("zookeeper: ", err)
 	}
-	exists, _, err := c.Exists(uri.Path)
-	if err != nil {
-		log.Println("zookeeper: error checking if base path exists:", err)
+
+	acl := zk.WorldACL(zk.PermAll)
+	if uri.User != nil {
+		user := uri.User.Username()
+		password, _ := uri.User.Password()
+		if err := c.AddAuth("digest", []byte(user+":"+password)); err != nil {
+			log.Fatal("zookeeper: failed to authenticate: ", err)
+		}
+		// Only we may change our znodes, but anyone may discover them.
+		acl = append(zk.DigestACL(zk.PermAll, user, password), zk.WorldACL(zk.PermRead)...)
+	}
+
+	format := uri.Query().Get("format")
+	switch format {
+	case "":
+		format = "registrator"
+	case "registrator", "curator", "serverset":
+	default:
+		log.Fatal("zookeeper: unknown format: ", format)
 	}
-	if !exists {
-		c.Create(uri.Path, []byte{}, 0, zk.WorldACL(zk.PermAll))
+
+	adapter := &ZkAdapter{
+		client:     c,
+		path:       basePath(uri),
+		acl:        acl,
+		format:     format,
+		sequential: uri.Query().Get("sequential") == "true",
+		nodes:      make(map[string]string),
+		services:   make(map[string]*bridge.Service),
+		since:      make(map[string]time.Time),
+		members:    make(map[string]*member),
+		watching:   make(map[string]bool),
+	}
+	if err := adapter.createPath(adapter.path); err != nil {
+		log.Println("zookeeper: failed to create base path:", err)
+	}
+	go adapter.session(events)
+	return adapter
+}
+
+// basePath returns the znode path services are registered below: the URI's
+// path, prefixed with the chroot option. The client has no chroot support of
+// its own, so the chroot is applied to every path instead.
+func basePath(uri *url.URL) string {
+	base := path.Join("/", uri.Query().Get("chroot"), uri.Path)
+	if base == "/" {
+		return ""
 	}
-	return &ZkAdapter{client: c, path: uri.Path}
+	return base
 }
 
 type ZkAdapter struct {
-	client *zk.Conn
-	path   string
+	sync.Mutex
+	client     *zk.Conn
+	path       string
+	acl        []zk.ACL
+	format     string
+	sequential bool
+
+	// znode path of each registered service, by service ID
+	nodes map[string]string
+	// registered services, to register again after the session expires
+	services map[string]*bridge.Service
+	// time of each service's first registration
+	since map[string]time.Time
+	// ServerSet member of each container, by container ID
+	members map[string]*member
+
+	removed  chan<- string
+	stop     <-chan struct{}
+	watching map[string]bool
 }
 
 type ZnodeBody struct {
@@ -47,34 +110,146 @@ type ZnodeBody struct {
 	Attrs       map[string]string
 }
 
+// CuratorInstance is the ServiceInstance JSON of Apache Curator's service
+// discovery, so JVM services can discover our services.
+type CuratorInstance struct {
+	Name                string                 `json:"name"`
+	ID                  string                 `json:"id"`
+	Address             string                 `json:"address"`
+	Port                int                    `json:"port"`
+	SslPort             *int                   `json:"sslPort"`
+	Payload             map[string]interface{} `json:"payload"`
+	RegistrationTimeUTC int64                  `json:"registrationTimeUTC"`
+	ServiceType         string                 `json:"serviceType"`
+	URISpec             interface{}            `json:"uriSpec"`
+}
+
+// Register creates an ephemeral znode for the service below its service
+// name, creating the name's parent znode first if needed. Registering an
+// already registered service updates its body.
 func (r *ZkAdapter) Register(service *bridge.Service) error {
-	privatePort, _ := strconv.Atoi(service.Origin.ExposedPort)
-	acl := zk.WorldACL(zk.PermAll)
+	if r.format == "serverset" {
+		return r.registerMember(service)
+	}
 
-	exists, _, err := r.client.Exists(r.path + "/" + service.Name)
+	body, err := r.body(service)
 	if err != nil {
-		log.Println("zookeeper: error checking if exists: ", err)
-	} else {
-		if !exists {
-			_, err := r.client.Create(r.path+"/"+service.Name, []byte{}, 0, acl)
-			if err != nil {
-				log.Println("zookeeper: failed to create base service node: ", err)
-			} else {
-				zbody := &ZnodeBody{Name: service.Name, IP: service.IP, PublicPort: service.Port, PrivatePort: privatePort, Tags: service.Tags, Attrs: service.Attrs, ContainerID: service.Origin.ContainerHostname}
-				body, err := json.Marshal(zbody)
-				if err != nil {
-					log.Println("zookeeper: failed to json encode service body: ", err)
-				} else {
-					path := r.path + "/" + service.Name + "/" + service.Origin.ExposedPort
-					_, err = r.client.Create(path, body, 1, acl)
-					if err != nil {
-						log.Println("zookeeper: failed to register service: ", err)
-					}
-				} // json encode error check
-			} // create service path error check
-		} // service path exists
-	} // service path exists error check
-	return err
+		log.Println("zookeeper: failed to json encode service body: ", err)
+		return err
+	}
+
+	r.Lock()
+	path, registered := r.nodes[service.ID]
+	r.Unlock()
+	if registered {
+		_, err = r.client.Set(path, body, -1) // -1 means any version
+		if err == nil {
+			return nil
+		}
+		if err != zk.ErrNoNode {
+			log.Println("zookeeper: failed to update service: ", err)
+			return err
+		}
+		// the znode is gone, e.g. with its session; create it again
+	}
+
+	base := r.path + "/" + service.Name
+	if err := r.createPath(base); err != nil {
+		log.Println("zookeeper: failed to create base service node: ", err)
+		return err
+	}
+
+	path = base + "/" + r.nodeName(service)
+	flags := int32(zk.FlagEphemeral)
+	if r.sequential && r.format != "curator" {
+		path += "-"
+		flags |= zk.FlagSequence
+	}
+	created, err := r.client.Create(path, body, flags, r.acl)
+	if err == zk.ErrNodeExists {
+		// left over from a previous session of ours that hasn't expired yet
+		created = path
+		_, err = r.client.Set(path, body, -1)
+	}
+	if err != nil {
+		log.Println("zookeeper: failed to register service: ", err)
+		return err
+	}
+
+	r.Lock()
+	r.nodes[service.ID] = created
+	r.services[service.ID] = service
+	r.Unlock()
+	r.watch(created)
+	return nil
+}
+
+// createPath creates a persistent znode and any missing parents.
+func (r *ZkAdapter) createPath(path string) error {
+	node := ""
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		node += "/" + part
+		_, err := r.client.Create(node, []byte{}, 0, r.acl)
+		if err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ZkAdapter) body(service *bridge.Service) ([]byte, error) {
+	if r.format == "curator" {
+		r.Lock()
+		since, ok := r.since[service.ID]
+		if !ok {
+			since = time.Now()
+			r.since[service.ID] = since
+		}
+		r.Unlock()
+
+		instance := &CuratorInstance{
+			Name:                service.Name,
+			ID:                  curatorID(service.ID),
+			Address:             service.IP,
+			Port:                service.Port,
+			RegistrationTimeUTC: since.UnixNano() / int64(time.Millisecond),
+			ServiceType:         "DYNAMIC",
+		}
+		if len(service.Attrs) > 0 {
+			// Curator's serializer records the payload's Java class
+			instance.Payload = map[string]interface{}{"@class": "java.util.LinkedHashMap"}
+			for k, v := range service.Attrs {
+				instance.Payload[k] = v
+			}
+		}
+		return json.Marshal(instance)
+	}
+
+	privatePort, _ := strconv.Atoi(service.Origin.ExposedPort)
+	zbody := &ZnodeBody{Name: service.Name, IP: service.IP, PublicPort: service.Port, PrivatePort: privatePort, Tags: service.Tags, Attrs: service.Attrs, ContainerID: service.Origin.ContainerHostname}
+	return json.Marshal(zbody)
+}
+
+// nodeName turns a service ID into a valid znode name. Curator instances are
+// named by their ID.
+func (r *ZkAdapter) nodeName(service *bridge.Service) string {
+	if r.format == "curator" {
+		return curatorID(service.ID)
+	}
+	return strings.Replace(service.ID, "/", "_", -1)
+}
+
+// curatorID derives a name based UUID from a service ID, so an instance keeps
+// its ID across restarts of Registrator.
+func curatorID(id string) string {
+	sum := sha1.Sum([]byte(id))
+	sum[6] = (sum[6] & 0x0f) | 0x50 // version 5
+	sum[8] = (sum[8] & 0x3f) | 0x80 // RFC 4122 variant
+	h := hex.EncodeToString(sum[:16])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
 }
 
 func (r *ZkAdapter) Ping() error {
@@ -86,26 +261,46 @@ func (r *ZkAdapter) Ping() error {
 	return nil
 }
 
+// Deregister removes the service's own znode, and its service name znode if
+// no other instance is left in it.
 func (r *ZkAdapter) Deregister(service *bridge.Service) error {
-	basePath := r.path + "/" + service.Name
-	// Delete the service-port znode
-	servicePortPath := basePath + "/" + service.Origin.ExposedPort
-	err := r.client.Delete(servicePortPath, -1) // -1 means latest version number
+	if r.format == "serverset" {
+		return r.deregisterMember(service)
+	}
+
+	r.Lock()
+	path, registered := r.nodes[service.ID]
+	delete(r.nodes, service.ID)
+	delete(r.services, service.ID)
+	delete(r.since, service.ID)
+	r.Unlock()
+	if !registered {
+		path = r.path + "/" + service.Name + "/" + r.nodeName(service)
+	}
+
+	err := r.deleteNode(path)
 	if err != nil {
-		log.Println("zookeeper: failed to deregister service port entry: ", err)
-	}
-	// Check if all service-port znodes are removed.
-	children, _, err := r.client.Children(basePath)
-	if len(children) == 0 {
-		// Delete the service name znode
-		err := r.client.Delete(basePath, -1)
-		if err != nil {
-			log.Println("zookeeper: failed to delete service path: ", err)
-		}
+		log.Println("zookeeper: failed to deregister service: ", err)
 	}
 	return err
 }
 
+// deleteNode deletes a znode, and its parent if no other znode is left in it.
+func (r *ZkAdapter) deleteNode(path string) error {
+	err := r.client.Delete(path, -1) // -1 means latest version number
+	if err != nil && err != zk.ErrNoNode {
+		return err
+	}
+
+	// Deleting fails if other instances remain, which is what we want.
+	parent := path[:strings.LastIndex(path, "/")]
+	err = r.client.Delete(parent, -1)
+	if err != nil && err != zk.ErrNotEmpty && err != zk.ErrNoNode {
+		log.Println("zookeeper: failed to delete service path: ", err)
+	}
+	return nil
+}
+
 func (r *ZkAdapter) Refresh(service *bridge.Service) error {
 	return r.Register(service)
 }
@@ -113,3 +308,95 @@ func (r *ZkAdapter) Refresh(service *bridge.Service) error {
 func (r *ZkAdapter) Services() ([]*bridge.Service, error) {
 	return []*bridge.Service{}, nil
 }
+
+// session follows the connection's session events. The client establishes a
+// new session by itself when the old one expires, but every ephemeral znode
+// went with the old session, so all registered services are created again.
+func (r *ZkAdapter) session(events <-chan zk.Event) {
+	expired := false
+	for ev := range events {
+		switch ev.State {
+		case zk.StateExpired:
+			log.Println("zookeeper: session expired, reconnecting")
+			expired = true
+		case zk.StateHasSession:
+			if expired {
+				expired = false
+				r.restore()
+			}
+		}
+	}
+}
+
+func (r *ZkAdapter) restore() {
+	r.Lock()
+	services := make([]*bridge.Service, 0, len(r.services))
+	for _, service := range r.services {
+		services = append(services, service)
+	}
+	r.Unlock()
+
+	log.Println("zookeeper: registering", len(services), "services again")
+	for _, service := range services {
+		r.Register(service)
+	}
+}
+
+// Watch reports services whose znodes are deleted, using watches set when
+// each service is registered.
+func (r *ZkAdapter) Watch(removed chan<- string, stop <-chan struct{}) error {
+	r.Lock()
+	r.removed = removed
+	r.stop = stop
+	r.Unlock()
+	<-stop
+	r.Lock()
+	r.removed = nil
+	r.stop = nil
+	r.Unlock()
+	return nil
+}
+
+// watch sets a watch on a znode, unless one is already set, and reports the
+// services registered with it to Watch once the znode is deleted.
+func (r *ZkAdapter) watch(path string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.watching[path] {
+		return
+	}
+	exists, _, events, err := r.client.ExistsW(path)
+	if err != nil || !exists {
+		return
+	}
+	r.watching[path] = true
+
+	go func() {
+		ev := <-events
+		r.Lock()
+		delete(r.watching, path)
+		removed, stop := r.removed, r.stop
+		var ids []string
+		for id, node := range r.nodes {
+			if node == path {
+				ids = append(ids, id)
+			}
+		}
+		r.Unlock()
+
+		switch ev.Type {
+		case zk.EventNodeDeleted:
+			if removed != nil {
+				for _, id := range ids {
+					select {
+					case removed <- id:
+					case <-stop:
+						return
+					}
+				}
+			}
+		case zk.EventNodeDataChanged:
+			r.watch(path)
+		}
+	}()
+}
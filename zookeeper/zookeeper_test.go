@@ -0,0 +1,285 @@
+package zookeeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/registrator/bridge"
+	"github.com/gliderlabs/registrator/bridge/adaptertest"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConformance(t *testing.T) {
+	cluster, err := zk.StartTestCluster(1, nil, nil)
+	if err != nil {
+		t.Skip("zookeeper test server unavailable:", err)
+	}
+	defer cluster.Stop()
+
+	uri := &url.URL{
+		Scheme: "zookeeper",
+		Host:   fmt.Sprintf("127.0.0.1:%d", cluster.Servers[0].Port),
+		Path:   "/adaptertest",
+	}
+	adapter := new(Factory).New(uri).(*ZkAdapter)
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Lookup: func(service *bridge.Service) (bool, error) {
+			return exists(adapter, service)
+		},
+	})
+}
+
+func exists(adapter *ZkAdapter, service *bridge.Service) (bool, error) {
+	adapter.Lock()
+	path, ok := adapter.nodes[service.ID]
+	adapter.Unlock()
+	if !ok {
+		return false, nil
+	}
+	found, _, err := adapter.client.Exists(path)
+	return found, err
+}
+
+func TestSequentialNodes(t *testing.T) {
+	cluster, err := zk.StartTestCluster(1, nil, nil)
+	if err != nil {
+		t.Skip("zookeeper test server unavailable:", err)
+	}
+	defer cluster.Stop()
+
+	uri := &url.URL{
+		Scheme:   "zookeeper",
+		Host:     fmt.Sprintf("127.0.0.1:%d", cluster.Servers[0].Port),
+		Path:     "/nested/base",
+		RawQuery: "sequential=true",
+	}
+	adapter := new(Factory).New(uri).(*ZkAdapter)
+	first := adaptertest.NewService("web", "web-1", 80)
+	second := adaptertest.NewService("web", "web-2", 80)
+	assert.NoError(t, adapter.Register(first))
+	assert.NoError(t, adapter.Register(second))
+	assert.NoError(t, adapter.Register(second))
+
+	children, _, err := adapter.client.Children("/nested/base/web")
+	assert.NoError(t, err)
+	assert.Len(t, children, 2)
+	assert.Regexp(t, "^"+first.ID+"-[0-9]{10}$", path.Base(adapter.nodes[first.ID]))
+
+	assert.NoError(t, adapter.Deregister(first))
+	found, _, _ := adapter.client.Exists("/nested/base/web")
+	assert.True(t, found)
+	assert.NoError(t, adapter.Deregister(second))
+	found, _, _ = adapter.client.Exists("/nested/base/web")
+	assert.False(t, found)
+}
+
+func TestSessionExpiry(t *testing.T) {
+	cluster, err := zk.StartTestCluster(1, nil, nil)
+	if err != nil {
+		t.Skip("zookeeper test server unavailable:", err)
+	}
+	defer cluster.Stop()
+
+	uri := &url.URL{
+		Scheme: "zookeeper",
+		Host:   fmt.Sprintf("127.0.0.1:%d,127.0.0.1:%d", cluster.Servers[0].Port, cluster.Servers[0].Port),
+		Path:   "/base",
+	}
+	adapter := new(Factory).New(uri).(*ZkAdapter)
+	service := adaptertest.NewService("web", "web-1", 80)
+	assert.NoError(t, adapter.Register(service))
+
+	// the ephemeral znode goes with the expired session
+	assert.NoError(t, adapter.client.Delete(adapter.nodes[service.ID], -1))
+	events := make(chan zk.Event, 2)
+	events <- zk.Event{Type: zk.EventSession, State: zk.StateExpired}
+	events <- zk.Event{Type: zk.EventSession, State: zk.StateHasSession}
+	close(events)
+	adapter.session(events)
+
+	found, err := exists(adapter, service)
+	assert.NoError(t, err)
+	assert.True(t, found)
+}
+
+func TestBasePath(t *testing.T) {
+	for uri, want := range map[string]string{
+		"zookeeper://zk1:2181":                        "",
+		"zookeeper://zk1:2181/":                       "",
+		"zookeeper://zk1:2181/base/":                  "/base",
+		"zookeeper://zk1:2181,zk2:2181/base":          "/base",
+		"zookeeper://zk1:2181/base?chroot=/app":       "/app/base",
+		"zookeeper://zk1:2181/base?chroot=app/":       "/app/base",
+		"zookeeper://zk1:2181?chroot=/app":            "/app",
+		"zookeeper://zk1:2181/a/base?chroot=/app/env": "/app/env/a/base",
+	} {
+		u, err := url.Parse(uri)
+		assert.NoError(t, err)
+		assert.Equal(t, want, basePath(u), uri)
+	}
+}
+
+func TestDigestACL(t *testing.T) {
+	cluster, err := zk.StartTestCluster(1, nil, nil)
+	if err != nil {
+		t.Skip("zookeeper test server unavailable:", err)
+	}
+	defer cluster.Stop()
+
+	uri := &url.URL{
+		Scheme:   "zookeeper",
+		User:     url.UserPassword("registrator", "secret"),
+		Host:     fmt.Sprintf("127.0.0.1:%d", cluster.Servers[0].Port),
+		Path:     "/base",
+		RawQuery: "chroot=/app",
+	}
+	adapter := new(Factory).New(uri).(*ZkAdapter)
+	service := adaptertest.NewService("web", "web-1", 80)
+	assert.NoError(t, adapter.Register(service))
+	assert.Equal(t, "/app/base/web/"+service.ID, adapter.nodes[service.ID])
+
+	acl, _, err := adapter.client.GetACL(adapter.nodes[service.ID])
+	assert.NoError(t, err)
+	assert.Equal(t, append(zk.DigestACL(zk.PermAll, "registrator", "secret"), zk.WorldACL(zk.PermRead)...), acl)
+
+	anonymous, _, err := zk.Connect([]string{uri.Host}, time.Second*10)
+	assert.NoError(t, err)
+	defer anonymous.Close()
+	_, _, err = anonymous.Get(adapter.nodes[service.ID])
+	assert.NoError(t, err)
+	_, err = anonymous.Set(adapter.nodes[service.ID], []byte("{}"), -1)
+	assert.Equal(t, zk.ErrNoAuth, err)
+}
+
+func TestCuratorFormat(t *testing.T) {
+	cluster, err := zk.StartTestCluster(1, nil, nil)
+	if err != nil {
+		t.Skip("zookeeper test server unavailable:", err)
+	}
+	defer cluster.Stop()
+
+	uri := &url.URL{
+		Scheme:   "zookeeper",
+		Host:     fmt.Sprintf("127.0.0.1:%d", cluster.Servers[0].Port),
+		Path:     "/discovery",
+		RawQuery: "format=curator",
+	}
+	adapter := new(Factory).New(uri).(*ZkAdapter)
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Lookup: func(service *bridge.Service) (bool, error) {
+			return exists(adapter, service)
+		},
+	})
+
+	service := adaptertest.NewService("web", "web-1", 80)
+	service.Attrs = map[string]string{"region": "eu"}
+	assert.NoError(t, adapter.Register(service))
+	id := curatorID(service.ID)
+	assert.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", id)
+	assert.Equal(t, "/discovery/web/"+id, adapter.nodes[service.ID])
+
+	data, _, err := adapter.client.Get(adapter.nodes[service.ID])
+	assert.NoError(t, err)
+	var instance CuratorInstance
+	assert.NoError(t, json.Unmarshal(data, &instance))
+	assert.Equal(t, "web", instance.Name)
+	assert.Equal(t, id, instance.ID)
+	assert.Equal(t, "127.0.0.1", instance.Address)
+	assert.Equal(t, 80, instance.Port)
+	assert.Nil(t, instance.SslPort)
+	assert.Equal(t, "DYNAMIC", instance.ServiceType)
+	assert.Equal(t, "eu", instance.Payload["region"])
+
+	// refreshing keeps the registration time
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, adapter.Refresh(service))
+	data, _, err = adapter.client.Get(adapter.nodes[service.ID])
+	assert.NoError(t, err)
+	var refreshed CuratorInstance
+	assert.NoError(t, json.Unmarshal(data, &refreshed))
+	assert.Equal(t, instance.RegistrationTimeUTC, refreshed.RegistrationTimeUTC)
+	assert.NoError(t, adapter.Deregister(service))
+}
+
+func TestCuratorID(t *testing.T) {
+	assert.Equal(t, curatorID("host:web-1:80"), curatorID("host:web-1:80"))
+	assert.NotEqual(t, curatorID("host:web-1:80"), curatorID("host:web-2:80"))
+}
+
+func TestServerSetFormat(t *testing.T) {
+	cluster, err := zk.StartTestCluster(1, nil, nil)
+	if err != nil {
+		t.Skip("zookeeper test server unavailable:", err)
+	}
+	defer cluster.Stop()
+
+	uri := &url.URL{
+		Scheme:   "zookeeper",
+		Host:     fmt.Sprintf("127.0.0.1:%d", cluster.Servers[0].Port),
+		Path:     "/serversets",
+		RawQuery: "format=serverset",
+	}
+	adapter := new(Factory).New(uri).(*ZkAdapter)
+	adaptertest.Run(t, adapter, adaptertest.Options{
+		Lookup: func(service *bridge.Service) (bool, error) {
+			return exists(adapter, service)
+		},
+	})
+
+	http := adaptertest.NewService("web", "web-1", 80)
+	http.Attrs = map[string]string{"shard": "2"}
+	admin := adaptertest.NewService("web-admin", "web-1", 9990)
+	admin.Attrs = map[string]string{"endpoint": "admin"}
+	assert.NoError(t, adapter.Register(admin))
+	assert.NoError(t, adapter.Register(http))
+
+	children, _, err := adapter.client.Children("/serversets/web")
+	assert.NoError(t, err)
+	assert.Len(t, children, 1)
+	assert.Regexp(t, "^member_[0-9]{10}$", children[0])
+	assert.Equal(t, adapter.nodes[http.ID], adapter.nodes[admin.ID])
+	found, _, _ := adapter.client.Exists("/serversets/web-admin")
+	assert.False(t, found)
+
+	data, _, err := adapter.client.Get(adapter.nodes[http.ID])
+	assert.NoError(t, err)
+	var set ServerSet
+	assert.NoError(t, json.Unmarshal(data, &set))
+	assert.Equal(t, Endpoint{Host: "127.0.0.1", Port: 80}, set.ServiceEndpoint)
+	assert.Equal(t, map[string]Endpoint{"admin": {Host: "127.0.0.1", Port: 9990}}, set.AdditionalEndpoints)
+	assert.Equal(t, "ALIVE", set.Status)
+	assert.Equal(t, 2, *set.Shard)
+
+	// the remaining port becomes the member's primary endpoint
+	assert.NoError(t, adapter.Deregister(http))
+	found, _, _ = adapter.client.Exists("/serversets/web")
+	assert.False(t, found)
+	children, _, err = adapter.client.Children("/serversets/web-admin")
+	assert.NoError(t, err)
+	assert.Len(t, children, 1)
+
+	assert.NoError(t, adapter.Deregister(admin))
+	found, _, _ = adapter.client.Exists("/serversets/web-admin")
+	assert.False(t, found)
+
+	// with the bridge's grouping, the first registration writes the member
+	// of the whole container
+	http.Origin.ContainerServices = []*bridge.Service{http, admin}
+	admin.Origin.ContainerServices = http.Origin.ContainerServices
+	assert.NoError(t, adapter.Register(admin))
+	assert.NotEmpty(t, adapter.nodes[http.ID])
+	assert.True(t, strings.HasPrefix(adapter.nodes[admin.ID], "/serversets/web/member_"))
+	data, _, err = adapter.client.Get(adapter.nodes[admin.ID])
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &set))
+	assert.Equal(t, Endpoint{Host: "127.0.0.1", Port: 80}, set.ServiceEndpoint)
+	assert.NoError(t, adapter.Register(http))
+	assert.NoError(t, adapter.Deregister(http))
+	assert.NoError(t, adapter.Deregister(admin))
+}